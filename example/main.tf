@@ -1,5 +1,8 @@
 provider "opennebula" {
-  endpoint = "opennebula.mycorp.com"
-  username = "oneuser"
-  password = "my-oneuser-api-key"
+  endpoint                  = "opennebula.mycorp.com"
+  username                  = "oneuser"
+  password                  = "my-oneuser-api-key"
+  login_token_lifetime      = "1h"                    # optional | exchange the password for a renewed login token
+  default_operation_timeout = "10m"                   # optional | how long to wait for resources to reach their target state
+  default_poll_interval     = "3s"                    # optional | minimum time between two state checks
 }
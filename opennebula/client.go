@@ -1,18 +1,52 @@
 package opennebula
 
 import (
+	"encoding/xml"
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/kolo/xmlrpc"
 )
 
 type Client struct {
 	Rcp      xmlrpc.Client
+	endpoint string
 	session  string
 	Username string
 	Password string
+
+	// Defaults for resources waiting on OpenNebula to reach a state
+	OperationTimeout time.Duration
+	PollInterval     time.Duration
+
+	// Set when the session uses a token obtained through one.user.login
+	tokenLifetime time.Duration
+	tokenExpiry   time.Time
+	mutex         sync.Mutex
+
+	// Shared by all VMs waiting to be deleted
+	vmPoller     *vmDonePoller
+	vmPollerOnce sync.Once
+
+	// Clients for other endpoints resources are pinned to, by their URL
+	endpoints      map[string]*Client
+	endpointsMutex sync.Mutex
+
+	// Address ranges of vnets recently looked up, by the vnet ID
+	vnetCache      map[int]*cachedVnet
+	vnetCacheMutex sync.Mutex
+
+	// Template attributes only oneadmin may set (VM_RESTRICTED_ATTR), not checked if empty
+	RestrictedAttributes []string
+	isAdmin              bool
+	isAdminErr           error
+	isAdminOnce          sync.Once
+
+	// Whether VM quotas are checked on plan
+	CheckQuotas bool
 }
 
 func NewClient(endpoint, username, password string) (*Client, error) {
@@ -23,16 +57,167 @@ func NewClient(endpoint, username, password string) (*Client, error) {
 
 	return &Client{
 		Rcp:      *client,
+		endpoint: endpoint,
 		session:  fmt.Sprintf("%s:%s", username, password),
 		Username: username,
 		Password: password,
+
+		OperationTimeout: 10 * time.Minute,
+		PollInterval:     3 * time.Second,
+
+		RestrictedAttributes: defaultRestrictedAttributes,
 	}, nil
 }
 
+// NewTokenClient returns a client authenticating with a token instead of a password
+func NewTokenClient(endpoint, username, token string) (*Client, error) {
+	client, err := NewClient(endpoint, username, "")
+	if err != nil {
+		return nil, err
+	}
+
+	client.session = fmt.Sprintf("%s:%s", username, token)
+	return client, nil
+}
+
+// ForEndpoint returns a client with the same credentials for another endpoint, e.g. the oned
+// of another zone. Each endpoint gets a single client, shared by all resources pinned to it.
+func (c *Client) ForEndpoint(endpoint string) (*Client, error) {
+	if endpoint == "" || endpoint == c.endpoint {
+		return c, nil
+	}
+
+	c.endpointsMutex.Lock()
+	defer c.endpointsMutex.Unlock()
+
+	if client, ok := c.endpoints[endpoint]; ok {
+		return client, nil
+	}
+
+	client, err := NewClient(endpoint, c.Username, c.Password)
+	if err != nil {
+		return nil, err
+	}
+	client.OperationTimeout = c.OperationTimeout
+	client.PollInterval = c.PollInterval
+	client.RestrictedAttributes = c.RestrictedAttributes
+	client.CheckQuotas = c.CheckQuotas
+
+	// login tokens are only valid on the endpoint that issued them
+	if c.tokenLifetime > 0 {
+		if err = client.UseLoginToken(c.tokenLifetime); err != nil {
+			return nil, fmt.Errorf("Could not obtain a login token from %s: %s", endpoint, err)
+		}
+	} else {
+		c.mutex.Lock()
+		client.session = c.session
+		c.mutex.Unlock()
+	}
+
+	if c.endpoints == nil {
+		c.endpoints = map[string]*Client{}
+	}
+	c.endpoints[endpoint] = client
+	log.Printf("[INFO] Created client for endpoint %s", endpoint)
+
+	return client, nil
+}
+
+// UseLoginToken exchanges the password for a token valid for the given lifetime, so the
+// password isn't sent on every call. The token is renewed shortly before it expires.
+func (c *Client) UseLoginToken(lifetime time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.tokenLifetime = lifetime
+	return c.login()
+}
+
+// login must be called with the mutex held
+func (c *Client) login() error {
+	var result []interface{}
+
+	args := []interface{}{
+		fmt.Sprintf("%s:%s", c.Username, c.Password),
+		c.Username,
+		"", // an empty token makes OpenNebula generate a new one
+		int(c.tokenLifetime.Seconds()),
+		-1, // keep the user's effective group
+	}
+	if err := c.Rcp.Call("one.user.login", args, &result); err != nil {
+		return err
+	}
+
+	token, err := c.IsSuccess(result)
+	if err != nil {
+		return err
+	}
+
+	c.session = fmt.Sprintf("%s:%s", c.Username, token)
+	c.tokenExpiry = time.Now().Add(c.tokenLifetime)
+	log.Printf("[INFO] Obtained OpenNebula login token for user %s, valid until %s", c.Username, c.tokenExpiry)
+
+	return nil
+}
+
+func (c *Client) currentSession() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// renew the token a bit before it expires, so it can't expire during a call
+	if c.tokenLifetime > 0 && time.Now().Add(time.Minute).After(c.tokenExpiry) {
+		if err := c.login(); err != nil {
+			return "", err
+		}
+	}
+
+	return c.session, nil
+}
+
+// The default VM_RESTRICTED_ATTR of oned.conf, as far as the provider sets them
+var defaultRestrictedAttributes = []string{
+	"NIC/INBOUND_AVG_BW", "NIC/INBOUND_PEAK_BW", "NIC/INBOUND_PEAK_KB",
+	"NIC/OUTBOUND_AVG_BW", "NIC/OUTBOUND_PEAK_BW", "NIC/OUTBOUND_PEAK_KB",
+	"CPU_COST", "MEMORY_COST", "DISK_COST", "PCI", "RAW",
+}
+
+// IsAdmin tells whether the user is in the oneadmin group, and may set restricted attributes
+func (c *Client) IsAdmin() (bool, error) {
+	c.isAdminOnce.Do(func() {
+		var user struct {
+			Id       int   `xml:"ID"`
+			GroupIds []int `xml:"GROUPS>ID"`
+		}
+
+		resp, err := c.Call("one.user.info", -1, false)
+		if err == nil {
+			err = xml.Unmarshal([]byte(resp), &user)
+		}
+		if err != nil {
+			c.isAdminErr = err
+			return
+		}
+
+		c.isAdmin = user.Id == 0
+		for _, id := range user.GroupIds {
+			if id == 0 {
+				c.isAdmin = true
+			}
+		}
+	})
+
+	return c.isAdmin, c.isAdminErr
+}
+
 func (c *Client) Call(command string, args ...interface{}) (string, error) {
 	var result []interface{}
 
-	args = append([]interface{}{c.session}, args...)
+	session, err := c.currentSession()
+	if err != nil {
+		return "", err
+	}
+
+	args = append([]interface{}{session}, args...)
 
 	if err := c.Rcp.Call(command, args, &result); err != nil {
 		return "", err
@@ -48,7 +233,13 @@ func (c *Client) Call(command string, args ...interface{}) (string, error) {
 
 func (c *Client) IsSuccess(result []interface{}) (res string, err error) {
 	if !result[0].(bool) {
-		err = fmt.Errorf("%s", result[1].(string))
+		code := 0
+		if len(result) > 2 {
+			if v, ok := result[2].(int64); ok {
+				code = int(v)
+			}
+		}
+		err = newOpenNebulaError(code, result[1].(string), c.Username)
 		return
 	}
 
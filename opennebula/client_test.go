@@ -0,0 +1,93 @@
+package opennebula
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientIsSuccess_permissionDenied(t *testing.T) {
+	client := &Client{Username: "dev"}
+
+	_, err := client.IsSuccess([]interface{}{
+		false,
+		"[one.vm.action] User [3] : Not authorized to perform MANAGE VM [42].",
+		int64(errorAuthorization),
+	})
+
+	permErr, ok := err.(*PermissionError)
+	if !ok {
+		t.Fatalf("Expected a *PermissionError, got %T: %s", err, err)
+	}
+
+	if permErr.User != "dev" || permErr.Right != "MANAGE" || permErr.Object != "VM" || permErr.Id != 42 {
+		t.Fatalf("Unexpected permission error decoded: %#v", permErr)
+	}
+
+	if !strings.HasPrefix(err.Error(), "user 'dev' lacks MANAGE on VM 42") {
+		t.Fatalf("Unexpected error message: %s", err)
+	}
+}
+
+func TestClientIsSuccess_otherFailure(t *testing.T) {
+	client := &Client{Username: "dev"}
+
+	_, err := client.IsSuccess([]interface{}{
+		false,
+		"[one.vm.info] Error getting virtual machine [42].",
+		int64(errorNoExists),
+	})
+
+	oneErr, ok := err.(*OpenNebulaError)
+	if !ok {
+		t.Fatalf("Expected an *OpenNebulaError, got %T: %s", err, err)
+	}
+
+	if oneErr.Code != errorNoExists {
+		t.Fatalf("Expected error code %d, got %d", errorNoExists, oneErr.Code)
+	}
+}
+
+func TestClientForEndpoint(t *testing.T) {
+	client, err := NewClient("http://zone0:2633/RPC2", "dev", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other, _ := client.ForEndpoint(""); other != client {
+		t.Fatalf("Expected the provider's client without an endpoint")
+	}
+
+	zone1, err := client.ForEndpoint("http://zone1:2633/RPC2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone1 == client || zone1.session != "dev:secret" {
+		t.Fatalf("Expected a separate client with the same credentials, got %#v", zone1)
+	}
+	if again, _ := client.ForEndpoint("http://zone1:2633/RPC2"); again != zone1 {
+		t.Fatalf("Expected the client of an endpoint to be shared")
+	}
+}
+
+func TestClientIsAdmin(t *testing.T) {
+	calls := []string{}
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.user.info": func() (interface{}, error) {
+			return "<USER><ID>3</ID><GROUPS><ID>100</ID><ID>0</ID></GROUPS></USER>", nil
+		},
+	}, &calls)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		admin, err := client.IsAdmin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !admin {
+			t.Fatalf("Expected a user in group 0 to be admin")
+		}
+	}
+	if len(calls) != 1 {
+		t.Fatalf("Expected the user to be looked up once, got calls %v", calls)
+	}
+}
@@ -0,0 +1,163 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+type Clusters struct {
+	Cluster []*Cluster `xml:"CLUSTER"`
+}
+
+type Cluster struct {
+	Id   int    `xml:"ID"`
+	Name string `xml:"NAME"`
+}
+
+type Hosts struct {
+	Host []*Host `xml:"HOST"`
+}
+
+type Host struct {
+	Id        int        `xml:"ID"`
+	Name      string     `xml:"NAME"`
+	State     int        `xml:"STATE"`
+	ClusterId int        `xml:"CLUSTER_ID"`
+	HostShare *HostShare `xml:"HOST_SHARE"`
+}
+
+type HostShare struct {
+	MaxCpu   int `xml:"MAX_CPU"`
+	CpuUsage int `xml:"CPU_USAGE"`
+	MaxMem   int `xml:"MAX_MEM"`
+	MemUsage int `xml:"MEM_USAGE"`
+}
+
+func dataSourceOpennebulaClusterCapacity() *schema.Resource {
+
+	return &schema.Resource{
+		Read: dataSourceOpennebulaClusterCapacityRead,
+
+		Schema: map[string]*schema.Schema{
+			"cluster_id": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"cluster_name"},
+			},
+			"cluster_name": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"cluster_id"},
+			},
+			"hosts": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Number of enabled hosts in the cluster",
+			},
+			"total_cpu": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "CPU of all enabled hosts, in percent (100 is one core)",
+			},
+			"allocated_cpu": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "CPU allocated to VMs, in percent (100 is one core)",
+			},
+			"free_cpu": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "CPU left for new VMs, in percent (100 is one core)",
+			},
+			"total_memory": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Memory of all enabled hosts, in MB",
+			},
+			"allocated_memory": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Memory allocated to VMs, in MB",
+			},
+			"free_memory": &schema.Schema{
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Memory left for new VMs, in MB",
+			},
+		},
+	}
+}
+
+func dataSourceOpennebulaClusterCapacityRead(d *schema.ResourceData, meta interface{}) error {
+	var cluster *Cluster
+	var clusters *Clusters
+	var hosts *Hosts
+
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.clusterpool.info")
+	if err != nil {
+		return err
+	}
+
+	if err = xml.Unmarshal([]byte(resp), &clusters); err != nil {
+		return err
+	}
+
+	name, byName := d.GetOk("cluster_name")
+	for _, c := range clusters.Cluster {
+		if (byName && c.Name == name.(string)) || (!byName && c.Id == d.Get("cluster_id").(int)) {
+			cluster = c
+			break
+		}
+	}
+
+	if cluster == nil {
+		d.SetId("")
+		log.Printf("Could not find cluster %v%v for user %s", d.Get("cluster_name"), d.Get("cluster_id"), client.Username)
+		return fmt.Errorf("Could not find cluster %v%v for user %s", d.Get("cluster_name"), d.Get("cluster_id"), client.Username)
+	}
+
+	resp, err = client.Call("one.hostpool.info")
+	if err != nil {
+		return err
+	}
+
+	if err = xml.Unmarshal([]byte(resp), &hosts); err != nil {
+		return err
+	}
+
+	count, totalCpu, allocatedCpu, totalMem, allocatedMem := 0, 0, 0, 0, 0
+	for _, h := range hosts.Host {
+		// disabled (4) and offline (8) hosts don't take new VMs
+		if h.ClusterId != cluster.Id || h.State == 4 || h.State == 8 || h.HostShare == nil {
+			continue
+		}
+
+		count++
+		totalCpu += h.HostShare.MaxCpu
+		allocatedCpu += h.HostShare.CpuUsage
+		totalMem += h.HostShare.MaxMem
+		allocatedMem += h.HostShare.MemUsage
+	}
+
+	d.SetId(strconv.Itoa(cluster.Id))
+	d.Set("cluster_id", cluster.Id)
+	d.Set("cluster_name", cluster.Name)
+	d.Set("hosts", count)
+	d.Set("total_cpu", totalCpu)
+	d.Set("allocated_cpu", allocatedCpu)
+	d.Set("free_cpu", totalCpu-allocatedCpu)
+	// OpenNebula reports host memory in KB
+	d.Set("total_memory", totalMem/1024)
+	d.Set("allocated_memory", allocatedMem/1024)
+	d.Set("free_memory", (totalMem-allocatedMem)/1024)
+
+	return nil
+}
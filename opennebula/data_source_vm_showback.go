@@ -0,0 +1,207 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Longest range of months a single lookup may cover, the showback pool can get large
+const showbackMaxMonths = 36
+
+type ShowbackRecords struct {
+	Showback []*Showback `xml:"SHOWBACK"`
+}
+
+type Showback struct {
+	VmId       int     `xml:"VMID"`
+	GroupId    int     `xml:"GID"`
+	Year       int     `xml:"YEAR"`
+	Month      int     `xml:"MONTH"`
+	CpuCost    float64 `xml:"CPU_COST"`
+	MemoryCost float64 `xml:"MEMORY_COST"`
+	DiskCost   float64 `xml:"DISK_COST"`
+	TotalCost  float64 `xml:"TOTAL_COST"`
+	Hours      float64 `xml:"HOURS"`
+}
+
+func dataSourceOpennebulaVmShowback() *schema.Resource {
+
+	return &schema.Resource{
+		Read: dataSourceOpennebulaVmShowbackRead,
+
+		Schema: map[string]*schema.Schema{
+			"vm_id": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ConflictsWith: []string{"group_id"},
+				Description:   "ID of the VM to report the costs of",
+			},
+			"group_id": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ConflictsWith: []string{"vm_id"},
+				Description:   "ID of the group to report the costs of all VMs of",
+			},
+			"start_month": &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				Description:  "First month of the report, as YYYY-MM",
+				ValidateFunc: validateShowbackMonth,
+			},
+			"end_month": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				Description:  "Last month of the report, as YYYY-MM. Defaults to the current month",
+				ValidateFunc: validateShowbackMonth,
+			},
+			"months": &schema.Schema{
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Costs of each month in the range, zero for months without showback records",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"month": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Month of the costs, as YYYY-MM",
+						},
+						"cpu_cost": {
+							Type:        schema.TypeFloat,
+							Computed:    true,
+							Description: "Cost of the CPU over the month",
+						},
+						"memory_cost": {
+							Type:        schema.TypeFloat,
+							Computed:    true,
+							Description: "Cost of the memory over the month",
+						},
+						"disk_cost": {
+							Type:        schema.TypeFloat,
+							Computed:    true,
+							Description: "Cost of the disks over the month",
+						},
+						"total_cost": {
+							Type:        schema.TypeFloat,
+							Computed:    true,
+							Description: "Cost of all resources over the month",
+						},
+						"hours": {
+							Type:        schema.TypeFloat,
+							Computed:    true,
+							Description: "Hours the VMs ran in the month",
+						},
+					},
+				},
+			},
+			"total_cost": &schema.Schema{
+				Type:        schema.TypeFloat,
+				Computed:    true,
+				Description: "Cost of all resources over the whole range",
+			},
+		},
+	}
+}
+
+func validateShowbackMonth(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := time.Parse("2006-01", v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q must be a month as YYYY-MM, got %q", k, v.(string)))
+	}
+	return
+}
+
+// showbackMonths sums up the records of each month from first to last, including months
+// without any records
+func showbackMonths(records []*Showback, first, last time.Time, matches func(*Showback) bool) ([]map[string]interface{}, float64) {
+	months := []map[string]interface{}{}
+	byMonth := map[string]map[string]interface{}{}
+	for month := first; !month.After(last); month = month.AddDate(0, 1, 0) {
+		m := map[string]interface{}{
+			"month":       month.Format("2006-01"),
+			"cpu_cost":    0.0,
+			"memory_cost": 0.0,
+			"disk_cost":   0.0,
+			"total_cost":  0.0,
+			"hours":       0.0,
+		}
+		months = append(months, m)
+		byMonth[m["month"].(string)] = m
+	}
+
+	total := 0.0
+	for _, r := range records {
+		m, ok := byMonth[fmt.Sprintf("%04d-%02d", r.Year, r.Month)]
+		if !ok || !matches(r) {
+			continue
+		}
+
+		m["cpu_cost"] = m["cpu_cost"].(float64) + r.CpuCost
+		m["memory_cost"] = m["memory_cost"].(float64) + r.MemoryCost
+		m["disk_cost"] = m["disk_cost"].(float64) + r.DiskCost
+		m["total_cost"] = m["total_cost"].(float64) + r.TotalCost
+		m["hours"] = m["hours"].(float64) + r.Hours
+		total += r.TotalCost
+	}
+
+	return months, total
+}
+
+func dataSourceOpennebulaVmShowbackRead(d *schema.ResourceData, meta interface{}) error {
+	var records *ShowbackRecords
+
+	client := meta.(*Client)
+
+	// months have already been validated
+	first, _ := time.Parse("2006-01", d.Get("start_month").(string))
+	last, _ := time.Parse("2006-01", time.Now().UTC().Format("2006-01"))
+	if end, ok := d.GetOk("end_month"); ok {
+		last, _ = time.Parse("2006-01", end.(string))
+	}
+
+	if last.Before(first) {
+		return fmt.Errorf("end_month %s is before start_month %s", last.Format("2006-01"), first.Format("2006-01"))
+	}
+	if first.AddDate(0, showbackMaxMonths, 0).Before(last.AddDate(0, 1, 0)) {
+		return fmt.Errorf("Showback range from %s to %s is longer than %d months", first.Format("2006-01"), last.Format("2006-01"), showbackMaxMonths)
+	}
+
+	vmId, byVm := d.GetOkExists("vm_id")
+	groupId, byGroup := d.GetOkExists("group_id")
+	if !byVm && !byGroup {
+		return fmt.Errorf("One of vm_id or group_id is required")
+	}
+
+	// -2: records of all VMs the user may see
+	resp, err := client.Call("one.vmpool.showback", -2,
+		int(first.Month()), first.Year(), int(last.Month()), last.Year())
+	if err != nil {
+		return err
+	}
+
+	if err = xml.Unmarshal([]byte(resp), &records); err != nil {
+		return err
+	}
+
+	months, total := showbackMonths(records.Showback, first, last, func(r *Showback) bool {
+		if byVm {
+			return r.VmId == vmId.(int)
+		}
+		return r.GroupId == groupId.(int)
+	})
+
+	if byVm {
+		d.SetId(fmt.Sprintf("vm-%d:%s:%s", vmId.(int), first.Format("2006-01"), last.Format("2006-01")))
+	} else {
+		d.SetId(fmt.Sprintf("group-%d:%s:%s", groupId.(int), first.Format("2006-01"), last.Format("2006-01")))
+	}
+	d.Set("end_month", last.Format("2006-01"))
+	d.Set("total_cost", total)
+	if err = d.Set("months", months); err != nil {
+		return err
+	}
+
+	return nil
+}
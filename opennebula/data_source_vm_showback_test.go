@@ -0,0 +1,32 @@
+package opennebula
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShowbackMonths(t *testing.T) {
+	first, _ := time.Parse("2006-01", "2018-11")
+	last, _ := time.Parse("2006-01", "2019-01")
+
+	records := []*Showback{
+		{VmId: 1, Year: 2018, Month: 11, CpuCost: 1, MemoryCost: 2, TotalCost: 3, Hours: 10},
+		{VmId: 2, Year: 2018, Month: 11, TotalCost: 100},
+		{VmId: 1, Year: 2019, Month: 1, DiskCost: 4, TotalCost: 4, Hours: 5},
+	}
+
+	months, total := showbackMonths(records, first, last, func(r *Showback) bool { return r.VmId == 1 })
+
+	if len(months) != 3 || months[0]["month"] != "2018-11" || months[2]["month"] != "2019-01" {
+		t.Fatalf("Expected the months 2018-11 to 2019-01, got %v", months)
+	}
+	if months[0]["total_cost"] != 3.0 || months[0]["hours"] != 10.0 {
+		t.Fatalf("Unexpected costs for 2018-11: %v", months[0])
+	}
+	if months[1]["total_cost"] != 0.0 {
+		t.Fatalf("Expected no costs for a month without records, got %v", months[1])
+	}
+	if total != 7.0 {
+		t.Fatalf("Expected a total cost of 7, got %v", total)
+	}
+}
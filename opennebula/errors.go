@@ -0,0 +1,84 @@
+package opennebula
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Error codes returned by OpenNebula as the third element of a failed XML-RPC response
+const (
+	errorAuthentication = 0x0100
+	errorAuthorization  = 0x0200
+	errorNoExists       = 0x0400
+	errorAction         = 0x0800
+	errorXmlRpcApi      = 0x1000
+	errorInternal       = 0x2000
+	errorAllocate       = 0x4000
+	errorLocked         = 0x8000
+)
+
+// OpenNebulaError is a failed call as reported by oned
+type OpenNebulaError struct {
+	Code    int
+	Message string
+}
+
+func (e *OpenNebulaError) Error() string {
+	return e.Message
+}
+
+// PermissionError is an authorization failure, decoded from the raw OpenNebula message
+type PermissionError struct {
+	User   string
+	Right  string
+	Object string
+	Id     int
+	Cause  *OpenNebulaError
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf(
+		"user '%s' lacks %s on %s %d: %s. OpenNebula said: %s",
+		e.User, e.Right, e.Object, e.Id, permissionHint(e.Right), e.Cause.Message)
+}
+
+// oned reports authorization failures as e.g.
+// "[one.vm.action] User [3] : Not authorized to perform MANAGE VM [42]."
+var notAuthorizedRegexp = regexp.MustCompile(`Not authorized to perform (USE|MANAGE|ADMIN|CREATE) ([A-Z_]+) \[(\d+)\]`)
+
+func permissionHint(right string) string {
+	switch right {
+	case "USE":
+		return "add 4 to the matching owner-group-other digit of its permissions, or grant it with an ACL rule"
+	case "MANAGE":
+		return "add 2 to the matching owner-group-other digit of its permissions, or grant it with an ACL rule"
+	case "ADMIN":
+		return "add 1 to the matching owner-group-other digit of its permissions, or grant it with an ACL rule"
+	}
+
+	return "grant it with an ACL rule"
+}
+
+// newOpenNebulaError builds the most specific error available for a failed call
+func newOpenNebulaError(code int, message, username string) error {
+	oneErr := &OpenNebulaError{Code: code, Message: message}
+	if code != errorAuthorization {
+		return oneErr
+	}
+
+	match := notAuthorizedRegexp.FindStringSubmatch(message)
+	if match == nil {
+		return oneErr
+	}
+
+	id, _ := strconv.Atoi(match[3])
+
+	return &PermissionError{
+		User:   username,
+		Right:  match[1],
+		Object: match[2],
+		Id:     id,
+		Cause:  oneErr,
+	}
+}
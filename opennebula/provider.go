@@ -1,6 +1,9 @@
 package opennebula
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -22,21 +25,81 @@ func Provider() terraform.ResourceProvider {
 			},
 			"password": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "The password for the user",
+				Optional:    true,
+				Sensitive:   true,
+				Description: "The password for the user. Either 'password' or 'token' is required",
 				DefaultFunc: schema.EnvDefaultFunc("OPENNEBULA_PASSWORD", nil),
 			},
+			"token": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				Description: "A login token of the user, used instead of the password",
+				DefaultFunc: schema.EnvDefaultFunc("OPENNEBULA_TOKEN", nil),
+			},
+			"login_token_lifetime": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "If set, exchange the password for a login token valid this long (e.g. '1h'), renewed when it expires. It has to be longer than 2m, as the token is renewed a minute ahead",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					lifetime, err := time.ParseDuration(v.(string))
+					if err != nil {
+						errors = append(errors, fmt.Errorf("%q is not a valid duration: %s", k, err))
+					} else if lifetime <= 2*time.Minute {
+						errors = append(errors, fmt.Errorf("%q must be longer than 2m, the token is renewed a minute before it expires", k))
+					}
+
+					return
+				},
+			},
+			"restricted_attributes": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Template attributes only oneadmin may set, as in VM_RESTRICTED_ATTR of oned.conf (e.g. 'NIC/INBOUND_AVG_BW'). Defaults to the ones OpenNebula restricts by default",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"check_restricted_attributes": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Fail on plan if a VM of a user outside the oneadmin group sets a restricted attribute",
+			},
+			"check_quotas": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Fail on plan if a new VM would exceed the VM quotas of the user or its group. Looks up the quotas for each VM created",
+			},
+			"default_operation_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "10m",
+				Description:  "How long to wait for a resource to reach its target state, as a duration (e.g. '30m')",
+				ValidateFunc: validateDuration,
+			},
+			"default_poll_interval": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "3s",
+				Description:  "Minimum time between two state checks while waiting for a resource, as a duration (e.g. '10s')",
+				ValidateFunc: validateDuration,
+			},
 		},
 
 		ResourcesMap: map[string]*schema.Resource{
-			"opennebula_template": resourceTemplate(),
-			"opennebula_vnet":     resourceVnet(),
-			"opennebula_vm":       resourceVm(),
-			"opennebula_image":    resourceImage(),
+			"opennebula_template":       resourceTemplate(),
+			"opennebula_vnet":           resourceVnet(),
+			"opennebula_vm":             resourceVm(),
+			"opennebula_image":          resourceImage(),
+			"opennebula_vm_disk_saveas": resourceVmDiskSaveas(),
 		},
 
 		DataSourcesMap: map[string]*schema.Resource{
-			"opennebula_template_id": dataSourceOpennebulaTemplateId(),
+			"opennebula_template_id":      dataSourceOpennebulaTemplateId(),
+			"opennebula_cluster_capacity": dataSourceOpennebulaClusterCapacity(),
+			"opennebula_vm_showback":      dataSourceOpennebulaVmShowback(),
 		},
 
 		ConfigureFunc: providerConfigure,
@@ -44,9 +107,77 @@ func Provider() terraform.ResourceProvider {
 }
 
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
-	return NewClient(
-		d.Get("endpoint").(string),
-		d.Get("username").(string),
-		d.Get("password").(string),
-	)
+	var client *Client
+	var err error
+
+	if token, ok := d.GetOk("token"); ok {
+		client, err = NewTokenClient(
+			d.Get("endpoint").(string),
+			d.Get("username").(string),
+			token.(string),
+		)
+	} else if password, ok := d.GetOk("password"); ok {
+		client, err = NewClient(
+			d.Get("endpoint").(string),
+			d.Get("username").(string),
+			password.(string),
+		)
+	} else {
+		return nil, fmt.Errorf("Either 'password' or 'token' is required to authenticate to OpenNebula")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if lifetime, ok := d.GetOk("login_token_lifetime"); ok {
+		if _, ok := d.GetOk("token"); ok {
+			return nil, fmt.Errorf("'login_token_lifetime' requires authenticating with 'password' instead of 'token'")
+		}
+
+		duration, _ := time.ParseDuration(lifetime.(string))
+		if err = client.UseLoginToken(duration); err != nil {
+			return nil, fmt.Errorf("Could not obtain a login token: %s", err)
+		}
+	}
+
+	if value, ok := d.GetOk("restricted_attributes"); ok {
+		client.RestrictedAttributes = []string{}
+		for _, attr := range value.([]interface{}) {
+			client.RestrictedAttributes = append(client.RestrictedAttributes, attr.(string))
+		}
+	}
+	if !d.Get("check_restricted_attributes").(bool) {
+		client.RestrictedAttributes = nil
+	}
+	client.CheckQuotas = d.Get("check_quotas").(bool)
+
+	// durations have already been validated
+	client.OperationTimeout, _ = time.ParseDuration(d.Get("default_operation_timeout").(string))
+	client.PollInterval, _ = time.ParseDuration(d.Get("default_poll_interval").(string))
+
+	return client, nil
+}
+
+func validateDuration(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := time.ParseDuration(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q is not a valid duration: %s", k, err))
+	}
+
+	return
+}
+
+func validateTime(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := time.Parse(time.RFC3339, v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q is not a valid RFC 3339 time: %s", k, err))
+	}
+
+	return
+}
+
+// suppressEqualTimes ignores differences in how the same RFC 3339 time is written
+func suppressEqualTimes(k, old, new string, d *schema.ResourceData) bool {
+	oldTime, oldErr := time.Parse(time.RFC3339, old)
+	newTime, newErr := time.Parse(time.RFC3339, new)
+
+	return oldErr == nil && newErr == nil && oldTime.Equal(newTime)
 }
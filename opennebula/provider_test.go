@@ -18,6 +18,15 @@ func TestProvider_impl(t *testing.T) {
 	var _ terraform.ResourceProvider = Provider()
 }
 
+func TestProvider_loginTokenLifetime(t *testing.T) {
+	validate := Provider().(*schema.Provider).Schema["login_token_lifetime"].ValidateFunc
+	for lifetime, valid := range map[string]bool{"1h": true, "3m": true, "2m": false, "30s": false, "soon": false} {
+		if _, errs := validate(lifetime, "login_token_lifetime"); (len(errs) == 0) != valid {
+			t.Fatalf("Expected lifetime %s valid: %t, got %v", lifetime, valid, errs)
+		}
+	}
+}
+
 var testAccProviders map[string]terraform.ResourceProvider
 var testAccProvider *schema.Provider
 
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -14,36 +15,76 @@ import (
 )
 
 type Image struct {
-	Name        string       `xml:"NAME"`
-	Id          int          `xml:"ID"`
-	Uid         int          `xml:"UID"`
-	Gid         int          `xml:"GID"`
-	Uname       string       `xml:"UNAME"`
-	Gname       string       `xml:"GNAME"`
-	Permissions *Permissions `xml:"PERMISSIONS"`
-	RegTime     string       `xml:"REG"`
-	Size        int          `xml:"SIZE"`
-	State       int          `xml:"STATE"`
-	Source      string       `xml:"SOURCE"`
-	Path        string       `xml:"PATH"`
-	Persistent  string       `xml:"PERSISTENT"`
-	DatastoreID int          `xml:"DATASTORE_ID"`
-	Datastore   string       `xml:"DATASTORE"`
-	FsType      string       `xml:"FSTYPE"`
-	RunningVMs  int          `xml:"RUNNING_VMS"`
+	Name        string         `xml:"NAME"`
+	Id          int            `xml:"ID"`
+	Uid         int            `xml:"UID"`
+	Gid         int            `xml:"GID"`
+	Uname       string         `xml:"UNAME"`
+	Gname       string         `xml:"GNAME"`
+	Permissions *Permissions   `xml:"PERMISSIONS"`
+	RegTime     string         `xml:"REG"`
+	Size        int            `xml:"SIZE"`
+	State       int            `xml:"STATE"`
+	Type        int            `xml:"TYPE"`
+	Source      string         `xml:"SOURCE"`
+	Path        string         `xml:"PATH"`
+	Persistent  string         `xml:"PERSISTENT"`
+	DatastoreID int            `xml:"DATASTORE_ID"`
+	Datastore   string         `xml:"DATASTORE"`
+	FsType      string         `xml:"FSTYPE"`
+	RunningVMs  int            `xml:"RUNNING_VMS"`
+	VmIds       []int          `xml:"VMS>ID"`
+	Template    *ImageTemplate `xml:"TEMPLATE"`
+}
+
+type ImageTemplate struct {
+	NoDecompress string `xml:"NO_DECOMPRESS"`
+	Md5          string `xml:"MD5"`
+	Sha256       string `xml:"SHA256"`
+	Driver       string `xml:"DRIVER"`
+	// Why the image is in state ERROR
+	Error string `xml:"ERROR"`
+}
+
+// validateChecksum returns a ValidateFunc for hex encoded checksums of the given length
+func validateChecksum(length int) schema.SchemaValidateFunc {
+	return func(v interface{}, k string) (ws []string, errors []error) {
+		if !regexp.MustCompile(fmt.Sprintf("^[0-9a-fA-F]{%d}$", length)).MatchString(v.(string)) {
+			errors = append(errors, fmt.Errorf("%q must be %d hex digits", k, length))
+		}
+
+		return
+	}
 }
 
 type Images struct {
 	Image []*Image `xml:"IMAGE"`
 }
 
+// Formats the datastore drivers convert images to with qemu-img
+var imageFormats = []string{"raw", "qcow2"}
+
+// Image types, indexed by the value OpenNebula reports in TYPE
+var imageTypes = []string{"OS", "CDROM", "DATABLOCK", "KERNEL", "RAMDISK", "CONTEXT"}
+
+// imageTypeFamily tells apart disk images from files, which live in different kinds of datastores
+func imageTypeFamily(t string) string {
+	switch t {
+	case "KERNEL", "RAMDISK", "CONTEXT":
+		return "file"
+	}
+
+	return "image"
+}
+
 func resourceImage() *schema.Resource {
 	return &schema.Resource{
-		Create: resourceImageCreate,
-		Read:   resourceImageRead,
-		Exists: resourceImageExists,
-		Update: resourceImageUpdate,
-		Delete: resourceImageDelete,
+		Create:        resourceImageCreate,
+		Read:          resourceImageRead,
+		Exists:        resourceImageExists,
+		Update:        resourceImageUpdate,
+		Delete:        resourceImageDelete,
+		CustomizeDiff: resourceImageCustomizeDiff,
 		Importer: &schema.ResourceImporter{
 			State: schema.ImportStatePassthrough,
 		},
@@ -114,11 +155,103 @@ func resourceImage() *schema.Resource {
 				Required:    true,
 				Description: "ID of the datastore where Image will be stored",
 			},
+			"path": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"source", "size", "clone_from_image"},
+				Description:   "Path or URL the datastore driver copies the Image from",
+			},
+			"source": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"path", "clone_from_image"},
+				Description:   "Location of the Image in the datastore, to register an existing one without copying it. Requires 'size'",
+			},
+			"size": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"path", "clone_from_image"},
+				Description:   "Size of the Image in MB: of the 'source', or of an empty DATABLOCK without a path",
+			},
+			"state": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "State of the Image, e.g. 1 (READY) or 2 (USED)",
+			},
+			"type": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Type of the Image: OS, CDROM, DATABLOCK, KERNEL, RAMDISK or CONTEXT",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+
+					for _, t := range imageTypes {
+						if value == t {
+							return
+						}
+					}
+					errors = append(errors, fmt.Errorf("%q must be one of %s", k, strings.Join(imageTypes, ", ")))
+
+					return
+				},
+			},
+			"no_decompress": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Keep the downloaded image as is, even if it's compressed",
+			},
+			"md5": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Description:  "MD5 checksum OpenNebula verifies the downloaded image against",
+				ValidateFunc: validateChecksum(32),
+			},
+			"sha256": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Description:  "SHA256 checksum OpenNebula verifies the downloaded image against",
+				ValidateFunc: validateChecksum(64),
+			},
+			"target_format": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Format the datastore driver converts the imported image to: raw or qcow2. The datastore has to allow conversions (CONVERT)",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					for _, format := range imageFormats {
+						if v.(string) == format {
+							return
+						}
+					}
+					errors = append(errors, fmt.Errorf("%q must be one of %s", k, strings.Join(imageFormats, ", ")))
+
+					return
+				},
+			},
 			"persistent": {
 				Type:        schema.TypeBool,
 				Optional:    true,
 				Default:     true,
-				Description: "Flag which indicates if the Image has to be persistent",
+				Description: "Flag which indicates if the Image has to be persistent. Can't be changed while VMs use the Image",
+			},
+			"vm_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "IDs of the VMs using the Image",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
 			},
 		},
 	}
@@ -138,10 +271,42 @@ func resourceImageCreate(d *schema.ResourceData, meta interface{}) error {
 		isPersistent = "YES"
 	}
 
+	template := ""
+	if value, ok := d.GetOk("type"); ok {
+		template = fmt.Sprintf("TYPE = \"%s\"\n", value)
+	}
+	if d.Get("no_decompress").(bool) {
+		template += "NO_DECOMPRESS = \"YES\"\n"
+	}
+	if value, ok := d.GetOk("md5"); ok {
+		template += fmt.Sprintf("MD5 = \"%s\"\n", value)
+	}
+	if value, ok := d.GetOk("sha256"); ok {
+		template += fmt.Sprintf("SHA256 = \"%s\"\n", value)
+	}
+	if value, ok := d.GetOk("path"); ok {
+		template += fmt.Sprintf("PATH = \"%s\"\n", value)
+	}
+	if value, ok := d.GetOk("source"); ok {
+		template += fmt.Sprintf("SOURCE = \"%s\"\n", value)
+	}
+	if value, ok := d.GetOk("size"); ok {
+		template += fmt.Sprintf("SIZE = \"%d\"\n", value)
+	}
+	if value, ok := d.GetOk("target_format"); ok {
+		template += fmt.Sprintf("DRIVER = \"%s\"\n", value)
+		// an empty datablock is created in that format instead of being converted to it
+		_, byPath := d.GetOk("path")
+		_, bySource := d.GetOk("source")
+		if !byPath && !bySource {
+			template += fmt.Sprintf("FORMAT = \"%s\"\n", value)
+		}
+	}
+
 	// Create base object
 	resp, err := client.Call(
 		"one.image.allocate",
-		fmt.Sprintf("NAME = \"%s\"\nPERSISTENT = \"%s\"\n", d.Get("name").(string), isPersistent)+d.Get("description").(string),
+		fmt.Sprintf("NAME = \"%s\"\nPERSISTENT = \"%s\"\n", d.Get("name").(string), isPersistent)+template+d.Get("description").(string),
 		d.Get("datastore_id"),
 	)
 	if err != nil {
@@ -207,6 +372,22 @@ func resourceImageClone(d *schema.ResourceData, meta interface{}) error {
 	return resourceImageRead(d, meta)
 }
 
+// imageError explains why an image is in state ERROR
+func imageError(img *Image) error {
+	message := ""
+	if img.Template != nil {
+		message = img.Template.Error
+	}
+
+	if strings.Contains(strings.ToLower(message), "checksum") {
+		return fmt.Errorf("Image %d failed the checksum verification, the downloaded file doesn't match 'md5' or 'sha256': %s", img.Id, message)
+	}
+	if strings.Contains(message, "qemu-img") {
+		return fmt.Errorf("Image %d could not be converted to %s by the datastore driver: %s", img.Id, img.Template.Driver, message)
+	}
+	return fmt.Errorf("Image %d is in state ERROR: %s", img.Id, message)
+}
+
 func waitForImageState(d *schema.ResourceData, meta interface{}, state string) (interface{}, error) {
 	var img *Image
 	client := meta.(*Client)
@@ -231,13 +412,15 @@ func waitForImageState(d *schema.ResourceData, meta interface{}, state string) (
 			log.Printf("Image is currently in state %v", img.State)
 			if img.State == 1 {
 				return img, "ready", nil
+			} else if img.State == 5 {
+				return nil, "", imageError(img)
 			} else {
 				return nil, "anythingelse", nil
 			}
 		},
-		Timeout:    10 * time.Minute,
+		Timeout:    client.OperationTimeout,
 		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
+		MinTimeout: client.PollInterval,
 	}
 
 	return stateConf.WaitForState()
@@ -296,6 +479,89 @@ func resourceImageRead(d *schema.ResourceData, meta interface{}) error {
 	d.Set("uname", img.Uname)
 	d.Set("gname", img.Gname)
 	d.Set("permissions", permissionString(img.Permissions))
+	if img.Type >= 0 && img.Type < len(imageTypes) {
+		d.Set("type", imageTypes[img.Type])
+	}
+	d.Set("persistent", img.Persistent == "1")
+	d.Set("path", img.Path)
+	d.Set("source", img.Source)
+	d.Set("size", img.Size)
+	d.Set("state", img.State)
+	d.Set("vm_ids", img.VmIds)
+	if img.Template != nil {
+		d.Set("no_decompress", img.Template.NoDecompress == "YES")
+		d.Set("md5", img.Template.Md5)
+		d.Set("sha256", img.Template.Sha256)
+		d.Set("target_format", img.Template.Driver)
+	}
+
+	return nil
+}
+
+func resourceImageCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	if d.Id() == "" {
+		if err := validateTargetFormat(d, meta); err != nil {
+			return err
+		}
+		if _, ok := d.GetOk("source"); ok {
+			if _, ok := d.GetOk("size"); !ok && d.NewValueKnown("size") {
+				return fmt.Errorf("%q requires %q, OpenNebula can't tell the size of an Image it doesn't copy", "source", "size")
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateTargetFormat checks the datastore converts images, to a format it can keep. A clone
+// keeps the format of its source image, as OpenNebula doesn't convert cloned images.
+func validateTargetFormat(d *schema.ResourceDiff, meta interface{}) error {
+	var ds struct {
+		TmMad   string `xml:"TM_MAD"`
+		Convert string `xml:"TEMPLATE>CONVERT"`
+	}
+
+	format, ok := d.GetOk("target_format")
+	if !ok || !d.NewValueKnown("target_format") || !d.NewValueKnown("datastore_id") {
+		return nil
+	}
+	client := meta.(*Client)
+
+	if source := d.Get("clone_from_image").(string); source != "" {
+		var imgs *Images
+		resp, err := client.Call("one.imagepool.info", -3, -1, -1)
+		if err != nil {
+			return err
+		}
+		if err = xml.Unmarshal([]byte(resp), &imgs); err != nil {
+			return err
+		}
+		for _, img := range imgs.Image {
+			if img.Name == source && img.Template != nil && img.Template.Driver != "" && img.Template.Driver != format.(string) {
+				return fmt.Errorf("%q %s can't be used with %q, image %s is in format %q and OpenNebula doesn't convert clones",
+					"target_format", format, "clone_from_image", source, img.Template.Driver)
+			}
+		}
+		return nil
+	}
+
+	resp, err := client.Call("one.datastore.info", d.Get("datastore_id").(int), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &ds); err != nil {
+		return err
+	}
+
+	// an empty datablock or a registered source isn't converted, it's created in or has the format
+	_, notConverted := d.GetOk("size")
+	if strings.ToUpper(ds.Convert) == "NO" && !notConverted {
+		return fmt.Errorf("Datastore %d doesn't convert images (CONVERT = NO), %q can't be used", d.Get("datastore_id"), "target_format")
+	}
+	// RBD images are always raw
+	if ds.TmMad == "ceph" && format.(string) != "raw" {
+		return fmt.Errorf("Datastore %d is a Ceph datastore, which only keeps raw images", d.Get("datastore_id"))
+	}
 
 	return nil
 }
@@ -369,6 +635,18 @@ func resourceImageUpdate(d *schema.ResourceData, meta interface{}) error {
 		log.Printf("[INFO] Successfully updated name for Image %s\n", resp)
 	}
 
+	if d.HasChange("datastore_id") {
+		if err := resourceImageMove(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("type") {
+		if err := resourceImageChangeType(d, meta); err != nil {
+			return err
+		}
+	}
+
 	if d.HasChange("permissions") {
 		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod")
 		if err != nil {
@@ -377,6 +655,133 @@ func resourceImageUpdate(d *schema.ResourceData, meta interface{}) error {
 		log.Printf("[INFO] Successfully updated Image %s\n", resp)
 	}
 
+	if d.HasChange("persistent") {
+		if err := resourceImageChangePersistent(d, meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resourceImageChangePersistent changes the persistency of the Image, which OpenNebula refuses
+// while any VM uses the Image
+func resourceImageChangePersistent(d *schema.ResourceData, meta interface{}) error {
+	var img *Image
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.image.info", intId(d.Id()), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+		return err
+	}
+
+	if len(img.VmIds) > 0 {
+		vmIds := []string{}
+		for _, id := range img.VmIds {
+			vmIds = append(vmIds, strconv.Itoa(id))
+		}
+		return fmt.Errorf("The persistency of Image %s can't be changed while it's used by VMs %s, terminate them or detach the Image first",
+			d.Id(), strings.Join(vmIds, ", "))
+	}
+
+	if _, err = client.Call("one.image.persistent", intId(d.Id()), d.Get("persistent")); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully changed persistency of Image %s to %t\n", d.Id(), d.Get("persistent"))
+	return nil
+}
+
+// resourceImageMove moves the Image to another datastore. OpenNebula can't move images, so the
+// Image is cloned into the new datastore and the original deleted once the clone is ready.
+func resourceImageMove(d *schema.ResourceData, meta interface{}) error {
+	var img *Image
+	client := meta.(*Client)
+	oldId := d.Id()
+
+	resp, err := client.Call("one.image.info", intId(oldId), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+		return err
+	}
+
+	if img.RunningVMs > 0 {
+		return fmt.Errorf("Cannot move Image %s to datastore %d: it is in use by %d VMs", oldId, d.Get("datastore_id"), img.RunningVMs)
+	}
+
+	// the clone can't share the name of the original while both exist
+	resp, err = client.Call(
+		"one.image.clone",
+		intId(oldId),
+		fmt.Sprintf("%s-moving-%s", img.Name, oldId),
+		d.Get("datastore_id"),
+	)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(resp)
+
+	_, err = waitForImageState(d, meta, "ready")
+	if err != nil {
+		d.SetId(oldId)
+		return fmt.Errorf("Error waiting for the copy (%s) of Image %s to be in state READY: %s", resp, oldId, err)
+	}
+
+	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.image.chmod"); err != nil {
+		return err
+	}
+
+	if _, err = client.Call("one.image.persistent", intId(d.Id()), d.Get("persistent")); err != nil {
+		return err
+	}
+
+	if _, err = client.Call("one.image.delete", intId(oldId), false); err != nil {
+		return fmt.Errorf("Image %s was copied to %s, but the original couldn't be deleted: %s", oldId, d.Id(), err)
+	}
+
+	if _, err = client.Call("one.image.rename", intId(d.Id()), d.Get("name").(string)); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully moved Image %s to datastore %d as Image %s\n", oldId, d.Get("datastore_id"), d.Id())
+	return nil
+}
+
+// resourceImageChangeType checks the type transition is one OpenNebula accepts before requesting it
+func resourceImageChangeType(d *schema.ResourceData, meta interface{}) error {
+	var img *Image
+	client := meta.(*Client)
+
+	oldType, newType := d.GetChange("type")
+	if imageTypeFamily(oldType.(string)) != imageTypeFamily(newType.(string)) {
+		return fmt.Errorf("Cannot change type of Image %s from %s to %s: disk images and files live in different datastores",
+			d.Id(), oldType, newType)
+	}
+
+	resp, err := client.Call("one.image.info", intId(d.Id()), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+		return err
+	}
+
+	if img.RunningVMs > 0 {
+		return fmt.Errorf("Cannot change type of Image %s: it is in use by %d VMs", d.Id(), img.RunningVMs)
+	}
+
+	resp, err = client.Call("one.image.chtype", intId(d.Id()), newType.(string))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Successfully changed type of Image %s\n", resp)
+
 	return nil
 }
 
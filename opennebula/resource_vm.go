@@ -1,9 +1,14 @@
 package opennebula
 
 import (
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -13,16 +18,27 @@ import (
 )
 
 type UserVm struct {
-	Id          string       `xml:"ID"`
-	Name        string       `xml:"NAME"`
-	Uid         int          `xml:"UID"`
-	Gid         int          `xml:"GID"`
-	Uname       string       `xml:"UNAME"`
-	Gname       string       `xml:"GNAME"`
-	Permissions *Permissions `xml:"PERMISSIONS"`
-	State       int          `xml:"STATE"`
-	LcmState    int          `xml:"LCM_STATE"`
-	VmTemplate  *VmTemplate  `xml:"TEMPLATE"`
+	Id             string          `xml:"ID"`
+	Name           string          `xml:"NAME"`
+	Uid            int             `xml:"UID"`
+	Gid            int             `xml:"GID"`
+	Uname          string          `xml:"UNAME"`
+	Gname          string          `xml:"GNAME"`
+	Permissions    *Permissions    `xml:"PERMISSIONS"`
+	State          int             `xml:"STATE"`
+	LcmState       int             `xml:"LCM_STATE"`
+	DeployId       string          `xml:"DEPLOY_ID"`
+	VmTemplate     *VmTemplate     `xml:"TEMPLATE"`
+	VmUserTemplate *VmUserTemplate `xml:"USER_TEMPLATE"`
+	History        []*History      `xml:"HISTORY_RECORDS>HISTORY"`
+	Monitoring     *Vector         `xml:"MONITORING"`
+}
+
+// History is a deployment of the VM on a host
+type History struct {
+	Hid      int    `xml:"HID"`
+	Hostname string `xml:"HOSTNAME"`
+	DsId     int    `xml:"DS_ID"`
 }
 
 type UserVms struct {
@@ -31,29 +47,185 @@ type UserVms struct {
 
 type VmTemplate struct {
 	Context *Context `xml:"CONTEXT"`
-	Nic     *Nic     `xml:"NIC"`
-	Disk    *Disk    `xml:"DISK"`
+	Nics    []*Nic   `xml:"NIC"`
+	Disks   []*Disk  `xml:"DISK"`
 	Cpu     int      `xml:"CPU"`
 	Vcpu    int      `xml:"VCPU"`
 	Memory  int      `xml:"MEMORY"`
+	// Limits for live resizes, if the template allows them
+	VcpuMax     int         `xml:"VCPU_MAX"`
+	MemoryMax   int         `xml:"MEMORY_MAX"`
+	MemorySlots int         `xml:"MEMORY_SLOTS"`
+	TemplateId  int         `xml:"TEMPLATE_ID"`
+	Pci         []*Pci      `xml:"PCI"`
+	Graphics    *Graphics   `xml:"GRAPHICS"`
+	Inputs      []*Input    `xml:"INPUT"`
+	Os          *Os         `xml:"OS"`
+	Topology    *Topology   `xml:"TOPOLOGY"`
+	Snapshots   []*Snapshot `xml:"SNAPSHOT"`
+	// Showback costs, per CPU and MB of memory or disk a month
+	CpuCost    string `xml:"CPU_COST"`
+	MemoryCost string `xml:"MEMORY_COST"`
+	DiskCost   string `xml:"DISK_COST"`
+	// OpenNebula >= 5.10 keeps scheduled actions in the template instead of the user template
+	SchedActions []*SchedAction `xml:"SCHED_ACTION"`
+	// The whole template as OpenNebula returned it
+	Raw string `xml:",innerxml"`
+}
+
+// Nic returns the NIC the VM was created with, i.e. the first one that isn't a floating IP
+func (t *VmTemplate) Nic() *Nic {
+	for _, nic := range t.Nics {
+		if nic.Floating != "YES" {
+			return nic
+		}
+	}
+
+	return nil
+}
+
+// Disk returns the disk the VM boots from, the first one
+func (t *VmTemplate) Disk() *Disk {
+	if len(t.Disks) == 0 {
+		return nil
+	}
+
+	return t.Disks[0]
+}
+
+type VmUserTemplate struct {
+	SchedRequirements   string         `xml:"SCHED_REQUIREMENTS"`
+	SchedDsRequirements string         `xml:"SCHED_DS_REQUIREMENTS"`
+	SchedMessage        string         `xml:"SCHED_MESSAGE"`
+	Error               string         `xml:"ERROR"`
+	ExternalId          string         `xml:"EXTERNAL_ID"`
+	SchedActions        []*SchedAction `xml:"SCHED_ACTION"`
+	// All attributes of the user template, including the ones above
+	Vector *Vector `xml:"-"`
+}
+
+func (t *VmUserTemplate) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+
+	// decode the same document twice, once for the known attributes and once for all
+	document := append(append([]byte("<USER_TEMPLATE>"), raw.Inner...), []byte("</USER_TEMPLATE>")...)
+	type plain VmUserTemplate
+	if err := xml.Unmarshal(document, (*plain)(t)); err != nil {
+		return err
+	}
+
+	t.Vector = &Vector{}
+	return xml.Unmarshal(document, t.Vector)
+}
+
+type SchedAction struct {
+	Id       int    `xml:"ID"`
+	Action   string `xml:"ACTION"`
+	Time     int64  `xml:"TIME"`
+	Repeat   string `xml:"REPEAT"`
+	Days     string `xml:"DAYS"`
+	EndType  string `xml:"END_TYPE"`
+	EndValue int64  `xml:"END_VALUE"`
 }
 
 type Context struct {
 	IP string `xml:"ETH0_IP"`
+	// All attributes of the context, including the ones above
+	Attributes map[string]string `xml:"-"`
+}
+
+func (c *Context) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v Vector
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+
+	c.Attributes = v.Map()
+	c.IP = c.Attributes["ETH0_IP"]
+	return nil
 }
 
 type Nic struct {
+	NicId               int    `xml:"NIC_ID"`
 	Network             string `xml:"NETWORK"`
+	NetworkId           int    `xml:"NETWORK_ID"`
+	ArId                int    `xml:"AR_ID"`
 	NetworkUname        string `xml:"NETWORK_UNAME"`
 	NetworkSearchDomain string `xml:"SEARCH_DOMAIN"`
-	SecurityGroupId     int    `xml:"SECURITY_GROUPS"`
+	SecurityGroups      string `xml:"SECURITY_GROUPS"`
+	Ip                  string `xml:"IP"`
+	Mac                 string `xml:"MAC"`
+	Floating            string `xml:"FLOATING"`
+	Raw                 string `xml:"RAW"`
+	InboundAvgBw        int    `xml:"INBOUND_AVG_BW"`
+	InboundPeakBw       int    `xml:"INBOUND_PEAK_BW"`
+	InboundPeakKb       int    `xml:"INBOUND_PEAK_KB"`
+	OutboundAvgBw       int    `xml:"OUTBOUND_AVG_BW"`
+	OutboundPeakBw      int    `xml:"OUTBOUND_PEAK_BW"`
+	OutboundPeakKb      int    `xml:"OUTBOUND_PEAK_KB"`
+}
+
+type Graphics struct {
+	Type           string `xml:"TYPE"`
+	Listen         string `xml:"LISTEN"`
+	Port           int    `xml:"PORT"`
+	Keymap         string `xml:"KEYMAP"`
+	TlsPort        int    `xml:"TLS_PORT"`
+	Sound          string `xml:"SOUND"`
+	UsbRedirection int    `xml:"USB_REDIRECTION"`
+}
+
+type Os struct {
+	Firmware       string `xml:"FIRMWARE"`
+	FirmwareSecure string `xml:"FIRMWARE_SECURE"`
+	Boot           string `xml:"BOOT"`
+}
+
+// Snapshot is a system snapshot of the VM
+type Snapshot struct {
+	Id   int    `xml:"SNAPSHOT_ID"`
+	Name string `xml:"NAME"`
+	Time int64  `xml:"TIME"`
+}
+
+type Topology struct {
+	PinPolicy       string `xml:"PIN_POLICY"`
+	Sockets         int    `xml:"SOCKETS"`
+	Cores           int    `xml:"CORES"`
+	Threads         int    `xml:"THREADS"`
+	EmulatorThreads string `xml:"EMULATOR_THREADS"`
+}
+
+type Input struct {
+	Type string `xml:"TYPE"`
+	Bus  string `xml:"BUS"`
+}
+
+type Pci struct {
+	Vendor  string `xml:"VENDOR"`
+	Device  string `xml:"DEVICE"`
+	Profile string `xml:"PROFILE"`
 }
 
 type Disk struct {
+	DiskId      int    `xml:"DISK_ID"`
 	Image       string `xml:"IMAGE"`
+	ImageId     int    `xml:"IMAGE_ID"`
 	Size        int    `xml:"SIZE"`
 	ImageDriver string `xml:"DRIVER"`
 	ImageUname  string `xml:"IMAGE_UNAME"`
+	ReadOnly    string `xml:"READONLY"`
+	Raw         string `xml:"RAW"`
+	Target      string `xml:"TARGET"`
+	DevPrefix   string `xml:"DEV_PREFIX"`
+	Persistent  string `xml:"PERSISTENT"`
+	// fs or swap for volatile disks, which aren't backed by an image
+	Type string `xml:"TYPE"`
 }
 
 func resourceVm() *schema.Resource {
@@ -64,8 +236,9 @@ func resourceVm() *schema.Resource {
 		Update: resourceVmUpdate,
 		Delete: resourceVmDelete,
 		Importer: &schema.ResourceImporter{
-			State: schema.ImportStatePassthrough,
+			State: resourceVmImportState,
 		},
+		CustomizeDiff: resourceVmCustomizeDiff,
 
 		Schema: map[string]*schema.Schema{
 			"name": {
@@ -73,6 +246,83 @@ func resourceVm() *schema.Resource {
 				Optional:    true,
 				Description: "Name of the VM. If empty, defaults to 'templatename-<vmid>'",
 			},
+			"external_id": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Unique tag kept in the user template (EXTERNAL_ID). Creating another VM with the same tag fails, and a VM can be imported as 'external_id:<tag>'",
+			},
+			"allow_duplicate_name": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Create the VM even if a VM with the same name exists already, only logging a warning",
+			},
+			"endpoint": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "URL of the oned managing the VM, e.g. the one of another zone. Defaults to the provider's endpoint",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					endpoint, err := url.Parse(v.(string))
+					if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+						errors = append(errors, fmt.Errorf("%q must be an http(s) URL, e.g. http://oned.example.com:2633/RPC2", k))
+					}
+
+					return
+				},
+			},
+			"host_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "ID of the host to deploy the VM on, instead of leaving it to the scheduler",
+			},
+			"on_hold": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Instantiate the VM on hold. With 'host_id' it's deployed there right away, bypassing the scheduler, otherwise it's left on hold until released",
+			},
+			"placement_mode": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "'auto' leaves placing the VM to the scheduler, 'manual' deploys it on 'host_id', which it requires. If unset, the VM is placed manually if 'host_id' is set",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if value := v.(string); value != "auto" && value != "manual" {
+						errors = append(errors, fmt.Errorf("%q must be auto or manual", k))
+					}
+
+					return
+				},
+			},
+			"deploy_datastore_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "ID of the system datastore to deploy the VM on. Requires 'host_id'",
+			},
+			"enforce_deploy_capacity": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Only deploy the VM on 'host_id' if the host has enough capacity left. Disable to overcommit the host",
+			},
+			"hypervisor": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Hypervisor the VM targets (kvm, lxc, firecracker or vcenter), to reject arguments it doesn't support at plan time",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if _, ok := vmHypervisorUnsupported[v.(string)]; !ok {
+						errors = append(errors, fmt.Errorf("%q must be one of kvm, lxc, firecracker or vcenter", k))
+					}
+
+					return
+				},
+			},
 			"instance": {
 				Type:        schema.TypeString,
 				Computed:    true,
@@ -87,57 +337,276 @@ func resourceVm() *schema.Resource {
 				Type:        schema.TypeInt,
 				Optional:    true,
 				Computed:    true,
-				ForceNew:    true,
-				Description: "CPU count of the VM instance",
+				Description: "CPU count of the VM instance. Only changed in place with a 'resize_strategy' stopping the VM",
 			},
 			"vcpu": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				Description: "VCPU count of the VM instance. Changed live up to 'vcpu_max', if it's set",
+			},
+			"vcpu_max": {
 				Type:        schema.TypeInt,
 				Optional:    true,
 				ForceNew:    true,
 				Computed:    true,
-				Description: "VCPU count of the VM instance",
+				Description: "Maximum VCPU count the VM can be resized to while running",
+			},
+			"hot_add_cpu": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Add VCPUs to the running guest up to 'vcpu_max' without stopping it, even with a 'resize_strategy' that stops the VM. Fails on plan if the VM can't hotplug them",
 			},
 			"memory": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				Description: "Memory in MB. Changed live up to 'memory_max', if it's set",
+			},
+			"memory_max": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				ForceNew:    true,
+				Computed:    true,
+				Description: "Maximum memory in MB the VM can be resized to while running",
+			},
+			"memory_slots": {
 				Type:        schema.TypeInt,
 				Optional:    true,
 				ForceNew:    true,
 				Computed:    true,
-				Description: "Memory in MB",
+				Description: "Number of memory slots available to hotplug memory into",
 			},
 			"image": {
-				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Image Name",
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"image_id", "disk"},
+				Description:   "Image Name. Either 'image', 'image_id', 'disk' or 'boot_from_network' is required",
 			},
 			"image_uname": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"disk"},
+				Description:   "Image Owner",
+			},
+			"image_driver": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"disk"},
+				Description:   "Image Driver",
+			},
+			"context_target": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
-				Description: "Image Owner",
+				Description: "Device the context CDROM is attached as (e.g. 'hda' or 'sr0')",
 			},
-			"image_driver": {
+			"context": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Attributes to add to the context of the VM template. Changes take effect on the next boot",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"ssh_public_key": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
-				Description: "Image Driver",
+				Description: "SSH public key(s) the guest authorizes for root. Changes take effect on the next boot",
 			},
-			"size": {
-				Type:        schema.TypeInt,
+			"start_script": {
+				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
-				Description: "VM Disk Size in MB",
+				Description: "Script the guest runs on every boot. Changes take effect on the next boot",
 			},
-			"network": {
+			"reboot_on_context_change": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Reboot a running VM when its context changes, so the guest applies it right away",
+			},
+			"wait_for_guest_agent": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Wait for the QEMU guest agent to report to OpenNebula after creating the VM. The image has to run the agent",
+			},
+			"guest_agent_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "5m",
+				Description:  "How long to wait for the guest agent, e.g. 5m",
+				ValidateFunc: validateDuration,
+			},
+			"detach_context_after_boot": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Detach the context CDROM once the guest signalled it booted, through its guest agent or READY=YES, freeing the device e.g. for installers. The VM is powered off meanwhile",
+			},
+			"set_hostname_from_dns": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Set the guest hostname to the reverse DNS name of its IP, or the VM name if there is none",
+			},
+			"image_clone": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"disk"},
+				Description:   "Give the VM its own copy of the image, leaving the source image untouched",
+			},
+			"boot_from_network": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"image", "image_id", "disk", "persistent_clone"},
+				Description:   "Create the VM without a boot disk, booting from its first NIC (PXE). The VM template must not define disks either",
+			},
+			"persistent_clone": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Instantiate a copy of the VM template whose images are cloned as persistent images, keeping the data of the VM once it's deleted",
+			},
+			"clone_name": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Network Name",
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Name of the template copy of persistent_clone, its images are named after it with a '-disk-<n>' suffix. Defaults to the VM name",
 			},
-			"ip": {
+			"cloned_template_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the template copy of persistent_clone",
+			},
+			"cloned_image_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "IDs of the images cloned for persistent_clone. They're left in the datastore when the VM is deleted",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"image_raw": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"disk"},
+				Description:   "Raw hypervisor specific data for the disk, passed on verbatim",
+			},
+			"image_readonly": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"disk"},
+				Description:   "Attach the disk read-only, e.g. for data shared by several VMs. Read-only disks can't be resized",
+			},
+			"image_id": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"image", "disk"},
+				Description:   "ID of the image backing the VM disk, unambiguous unlike its name",
+			},
+			"size": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"disk"},
+				Description:   "VM Disk Size in MB",
+			},
+			"disk": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"image", "image_id", "image_uname", "image_driver", "image_clone", "image_raw", "image_readonly", "size"},
+				Description:   "Disks to create the VM with, booting from the first, instead of the single disk of 'image' or 'image_id'. Only their size can be changed in place",
+				Elem: &schema.Resource{
+					Schema: diskSchema(),
+				},
+			},
+			"resize_strategy": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "How to apply changes of cpu, vcpu, memory and size: 'live', or stopping the VM with 'poweroff' or 'cold' (undeploy) and starting it again. If unset, changes that can't be applied live recreate the VM",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if value := v.(string); value != "live" && value != "poweroff" && value != "cold" {
+						errors = append(errors, fmt.Errorf("%q must be live, poweroff or cold", k))
+					}
+
+					return
+				},
+			},
+			"dev_prefix": {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Computed:    true,
 				ForceNew:    true,
-				Description: "Optional IP Addr. for Network",
+				Description: "Prefix of the device names of all disks not setting their own, e.g. 'vd' for virtio or 'sd' for SCSI",
+			},
+			"data_disk": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Persistent images attached as additional disks. The images outlive the VM, which never deletes them",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"image_id": {
+							Type:        schema.TypeInt,
+							Required:    true,
+							Description: "ID of the persistent image",
+						},
+						"target": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Device the disk is attached as, e.g. 'vdb'. Assigned by OpenNebula if empty",
+						},
+						"dev_prefix": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Prefix of the device name, defaults to the 'dev_prefix' of the VM",
+						},
+						"disk_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the disk within the VM",
+						},
+						"persistent": {
+							Type:        schema.TypeBool,
+							Computed:    true,
+							Description: "Whether the image is persistent, i.e. changes are kept in the image",
+						},
+					},
+				},
+			},
+			"network": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"nic"},
+				Description:   "Network Name. Changing it reattaches the NIC. Either 'network' or 'nic' is required",
+			},
+			"nic": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"network", "network_uname", "ip", "preserve_ip", "security_group_id", "network_bandwidth", "network_raw", "network_search_domain", "network_context"},
+				Description:   "NICs to create the VM with, instead of the single NIC of 'network'",
+				Elem: &schema.Resource{
+					Schema: nicSchema(),
+				},
+			},
+			"ip": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"nic"},
+				Description:   "Optional IP Addr. for Network. Changing it requires a new VM, unless the network changes too",
 				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
 					value := v.(string)
 
@@ -160,319 +629,3477 @@ func resourceVm() *schema.Resource {
 					return
 				},
 			},
+			"preserve_ip": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				Default:       false,
+				ConflictsWith: []string{"nic"},
+				Description:   "Keep the IP when the network changes, failing if the new network can't lease it. Otherwise the NIC gets a new IP from the new network, unless ip is changed as well",
+			},
 			"network_uname": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Computed:    true,
-				Description: "Network Owner",
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"nic"},
+				Description:   "Network Owner",
+			},
+			"network_bandwidth": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				MaxItems:      1,
+				ConflictsWith: []string{"nic"},
+				Description:   "Bandwidth limits of the NIC. Changing them reattaches the NIC",
+				Elem: &schema.Resource{
+					Schema: nicBandwidthSchema(),
+				},
+			},
+			"network_raw": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nic"},
+				Description:   "Raw hypervisor specific data for the NIC, passed on verbatim. Changing it reattaches the NIC",
 			},
 			"network_search_domain": {
-				Type:        schema.TypeString,
-				Optional:    true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"nic"},
+				Description:   "Network Search Domain",
+			},
+			"network_context": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				MaxItems:      1,
+				ConflictsWith: []string{"nic"},
+				Description:   "Network configuration the guest applies to the NIC, overriding the one of the virtual network",
+				Elem: &schema.Resource{
+					Schema: nicContextSchema(),
+				},
+			},
+			"guest_network": {
+				Type:        schema.TypeList,
 				Computed:    true,
-				Description: "Network Search Domain",
+				Description: "Addressing of each NIC as the guest receives it from the context (ETH<index>_*)",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"index": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Index of the NIC in the context, i.e. ETH<index>",
+						},
+						"mac": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "MAC address the guest matches the interface by",
+						},
+						"ip": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "IPv4 address",
+						},
+						"mask": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Network mask",
+						},
+						"gateway": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Default gateway",
+						},
+						"dns": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "DNS servers (space separated)",
+						},
+						"ip6": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "IPv6 address",
+						},
+					},
+				},
+			},
+			"floating_ip": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "IPs held on a vnet to attach as additional NICs, e.g. for VRRP. They're held again once detached",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"network": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Name of the vnet holding the IP",
+						},
+						"ip": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Held IP to attach",
+						},
+					},
+				},
 			},
 			"security_group_id": {
-				Type:        schema.TypeInt,
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"nic"},
+				Description:   "Security Group ID",
+			},
+			"security_group_ids": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "IDs of security groups applied to every NIC of the VM, on top of 'security_group_id' or the ones of each nic block. Changing them with nic blocks requires a new VM",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"affinity": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Place the VM relative to the hosts currently running other VMs",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"vm_ids": {
+							Type:        schema.TypeList,
+							Required:    true,
+							MinItems:    1,
+							Description: "IDs of the VMs to place this VM relative to",
+							Elem: &schema.Schema{
+								Type: schema.TypeInt,
+							},
+						},
+						"policy": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "anti-affinity",
+							Description: "Either 'affinity' (share a host with all VMs) or 'anti-affinity' (avoid the hosts of all VMs)",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								value := v.(string)
+
+								if value != "affinity" && value != "anti-affinity" {
+									errors = append(errors, fmt.Errorf("%q must be either 'affinity' or 'anti-affinity'", k))
+								}
+
+								return
+							},
+						},
+					},
+				},
+			},
+			"graphics": {
+				Type:        schema.TypeList,
 				Optional:    true,
 				Computed:    true,
-				Description: "Security Group ID",
+				MaxItems:    1,
+				Description: "Remote console of the VM",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Protocol of the console: VNC or SPICE",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								if value := v.(string); value != "VNC" && value != "SPICE" {
+									errors = append(errors, fmt.Errorf("%q must be VNC or SPICE", k))
+								}
+
+								return
+							},
+						},
+						"listen": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Address the console listens on, e.g. 0.0.0.0",
+						},
+						"port": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Port of the console. Assigned by OpenNebula if empty",
+						},
+						"keymap": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Keyboard layout of the console, e.g. de",
+						},
+						"tls_port": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Port of the TLS encrypted SPICE channels (SPICE only)",
+						},
+						"sound": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Play the guest sound on the client (SPICE only)",
+						},
+						"usb_redirection": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "Number of USB devices the client can redirect to the guest (SPICE only)",
+						},
+						"passwd": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Password of the console. Changed in place, taking effect on the next connection",
+						},
+					},
+				},
 			},
-			"permissions": {
-				Type:        schema.TypeString,
+			"os": {
+				Type:        schema.TypeList,
 				Optional:    true,
 				Computed:    true,
-				Description: "Permissions for the template (in Unix format, owner-group-other, use-manage-admin)",
-				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
-					value := v.(string)
+				MaxItems:    1,
+				Description: "Firmware the VM boots with. Other OS settings are taken from the VM template. Only changed while the VM is powered off",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"firmware": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "BIOS",
+							Description: "BIOS or UEFI",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								if value := v.(string); value != "BIOS" && value != "UEFI" {
+									errors = append(errors, fmt.Errorf("%q must be BIOS or UEFI", k))
+								}
 
-					if len(value) != 3 {
-						errors = append(errors, fmt.Errorf("%q has specify 3 permission sets: owner-group-other", k))
-					}
+								return
+							},
+						},
+						"firmware_secure": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Enable secure boot, which requires UEFI",
+						},
+						"boot": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Boot order of the devices, e.g. 'disk0,nic0'. disk0 is the boot disk, if any, followed by the data disks, nic0 the NIC followed by the floating IPs",
+						},
+					},
+				},
+			},
+			"input": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Input devices of the console, e.g. a USB tablet for an absolute pointer over VNC",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Type of the device: mouse or tablet",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								if value := v.(string); value != "mouse" && value != "tablet" {
+									errors = append(errors, fmt.Errorf("%q must be mouse or tablet", k))
+								}
 
-					all := true
-					for _, c := range strings.Split(value, "") {
-						if c < "0" || c > "7" {
-							all = false
-						}
-					}
-					if !all {
-						errors = append(errors, fmt.Errorf("Each character in %q should specify a Unix-like permission set with a number from 0 to 7", k))
-					}
+								return
+							},
+						},
+						"bus": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Bus of the device: usb or ps2",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								if value := v.(string); value != "usb" && value != "ps2" {
+									errors = append(errors, fmt.Errorf("%q must be usb or ps2", k))
+								}
 
-					return
+								return
+							},
+						},
+					},
 				},
 			},
-
-			"uid": {
-				Type:        schema.TypeInt,
+			"vgpu": {
+				Type:        schema.TypeList,
+				Optional:    true,
 				Computed:    true,
-				Description: "ID of the user that will own the VM",
+				ForceNew:    true,
+				Description: "Mediated GPU devices (e.g. NVIDIA vGPU or MIG profiles) to assign to the VM",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"device": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "PCI device ID of the GPU, in hex (e.g. '1eb8')",
+						},
+						"vendor": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "PCI vendor ID of the GPU, in hex (e.g. '10de')",
+						},
+						"profile": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "vGPU profile to create the mediated device with (e.g. 'nvidia-63')",
+						},
+					},
+				},
 			},
-			"gid": {
-				Type:        schema.TypeInt,
+			"topology": {
+				Type:        schema.TypeList,
+				Optional:    true,
 				Computed:    true,
-				Description: "ID of the group that will own the VM",
+				ForceNew:    true,
+				MaxItems:    1,
+				Description: "Virtual CPU topology and pinning of the VM to host cores, e.g. for real-time or NFV workloads",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"pin_policy": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "NONE",
+							Description: "How vCPUs are pinned to host CPUs: NONE, CORE, THREAD or SHARED",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								switch v.(string) {
+								case "NONE", "CORE", "THREAD", "SHARED":
+								default:
+									errors = append(errors, fmt.Errorf("%q must be one of NONE, CORE, THREAD or SHARED, got %q", k, v))
+								}
+								return
+							},
+						},
+						"sockets": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Number of virtual sockets",
+						},
+						"cores": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Number of cores per socket",
+						},
+						"threads": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Computed:    true,
+							Description: "Number of threads per core",
+						},
+						"emulator_threads": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Host CPUs (e.g. '0-1,4') the emulator threads are pinned to, keeping them off the cores of the vCPUs. Requires a pin_policy other than NONE",
+						},
+					},
+				},
 			},
-			"uname": {
+			"metadata": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Custom attributes of the VM's user template, e.g. for monitoring or accounting (COST_CENTER = ...)",
+			},
+			"user_inputs": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				ForceNew:    true,
+				Sensitive:   true,
+				Description: "Values for the USER_INPUTS the VM template asks for on instantiate",
+			},
+			"ttl": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"terminate_at"},
+				Description:   "Have OpenNebula terminate the VM after this duration (e.g. '12h'), even if the Terraform state is lost",
+				ValidateFunc:  validateDuration,
+			},
+			"terminate_at": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				ForceNew:         true,
+				Description:      "Have OpenNebula terminate the VM at this time (RFC 3339), even if the Terraform state is lost",
+				ValidateFunc:     validateTime,
+				DiffSuppressFunc: suppressEqualTimes,
+			},
+			"sched_action": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Actions OpenNebula runs on the VM at a given time, e.g. a recurring backup. Terminating the VM is up to 'ttl' and 'terminate_at'",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the scheduled action. Blocks are matched to their action by content, not by this ID",
+						},
+						"action": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Action to run, e.g. 'backup', 'snapshot-create', 'poweroff' or 'resume'",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								if v.(string) == "terminate" || v.(string) == "terminate-hard" {
+									errors = append(errors, fmt.Errorf("%q can't be %s, use 'ttl' or 'terminate_at' instead", k, v.(string)))
+								}
+
+								return
+							},
+						},
+						"time": {
+							Type:             schema.TypeString,
+							Required:         true,
+							Description:      "Time (RFC 3339) to run the action at, the first time if it's repeated",
+							ValidateFunc:     validateTime,
+							DiffSuppressFunc: suppressEqualTimes,
+						},
+						"repeat": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Repeat the action 'hourly', 'weekly', 'monthly' or 'yearly'",
+							ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+								if _, ok := schedActionRepeats[v.(string)]; !ok {
+									errors = append(errors, fmt.Errorf("%q must be hourly, weekly, monthly or yearly", k))
+								}
+
+								return
+							},
+						},
+						"days": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "When to repeat the action: comma separated days of the week (0-6), month (1-31) or year (0-365), or the number of hours between runs",
+						},
+						"end_time": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Description:      "Time (RFC 3339) to stop repeating the action at, repeat it forever if unset",
+							ValidateFunc:     validateTime,
+							DiffSuppressFunc: suppressEqualTimes,
+						},
+					},
+				},
+			},
+			"sched_requirements": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"affinity"},
+				Description:   "Requirements for the host the VM is placed on, e.g. 'CLUSTER_ID = 100'. Includes the 'affinity', if it's set",
+			},
+			"reschedule_on_requirement_change": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Reschedule the VM when 'sched_requirements' changes, so it's moved to a host meeting them",
+			},
+			"sched_message": {
 				Type:        schema.TypeString,
 				Computed:    true,
-				Description: "Name of the user that will own the VM",
+				Description: "Why the scheduler couldn't place the VM, if it couldn't",
 			},
-			"gname": {
+			"error_message": {
 				Type:        schema.TypeString,
 				Computed:    true,
-				Description: "Name of the group that will own the VM",
+				Description: "Error OpenNebula recorded for the last failed operation on the VM, empty once it recovered",
 			},
-			"state": {
-				Type:        schema.TypeInt,
-				Computed:    true,
-				Description: "Current state of the VM",
+			"sched_ds_requirements": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Requirements for the system datastore the VM is placed on, e.g. 'SPEED = \"ssd\"'",
+			},
+			"cpu_cost": {
+				Type:        schema.TypeFloat,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Cost of each CPU of the VM for showback, defaults to the one of the VM template. Showback only takes the costs the VM was instantiated with into account",
+			},
+			"memory_cost": {
+				Type:        schema.TypeFloat,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Cost of each MB of memory of the VM for showback, defaults to the one of the VM template. Showback only takes the costs the VM was instantiated with into account",
+			},
+			"disk_cost": {
+				Type:        schema.TypeFloat,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Cost of each MB of disk of the VM for showback, defaults to the one of the VM template. Showback only takes the costs the VM was instantiated with into account",
+			},
+			"network_parent_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the vnet 'network' is a reservation from, -1 if it isn't a reservation",
+			},
+			"network_mac": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "MAC address of the NIC, as assigned by OpenNebula. It's kept across reboots and power cycles",
+			},
+			"network_gateway": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Gateway of the NIC, as configured on the address range of its lease or the vnet",
+			},
+			"network_dns": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "DNS servers of the NIC, as configured on the address range of its lease or the vnet",
+			},
+			"network_security_group_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "IDs of all security groups applied to the NIC",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"manage_permissions": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Set the permissions of the VM after creating it and when they change. Users without MANAGE rights on their VMs have to disable this",
+			},
+			"permissions": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Permissions for the template (in Unix format, owner-group-other, use-manage-admin)",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+
+					if len(value) != 3 {
+						errors = append(errors, fmt.Errorf("%q has specify 3 permission sets: owner-group-other", k))
+					}
+
+					all := true
+					for _, c := range strings.Split(value, "") {
+						if c < "0" || c > "7" {
+							all = false
+						}
+					}
+					if !all {
+						errors = append(errors, fmt.Errorf("Each character in %q should specify a Unix-like permission set with a number from 0 to 7", k))
+					}
+
+					return
+				},
+			},
+
+			"uid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the user that will own the VM",
+			},
+			"gid": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the group that will own the VM",
+			},
+			"uname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the user that will own the VM",
+			},
+			"gname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the group that will own the VM",
+			},
+			"state": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Current state of the VM",
 			},
 			"lcmstate": {
 				Type:        schema.TypeInt,
 				Computed:    true,
 				Description: "Current LCM state of the VM",
 			},
+			"snapshots": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "System snapshots of the VM, however they were taken",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the snapshot",
+						},
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Name of the snapshot",
+						},
+						"time": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "When the snapshot was taken, in RFC3339",
+						},
+					},
+				},
+			},
+			"deploy_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Name of the VM on its host, e.g. the libvirt domain ('one-<id>'). Empty until the VM is deployed",
+			},
+			"template_inherited": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Arguments left unset on create, which the VM may have inherited from its template instead. They're kept out of the state, so a value of the template doesn't show up as a change",
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"full_template": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Template of the VM as stored by OpenNebula, in XML",
+			},
+			"record_lifecycle": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Record the states the VM passes through while the provider waits for it in 'lifecycle_log'",
+			},
+			"lifecycle_log": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "States the VM was seen in while waiting for it, the latest 50 if 'record_lifecycle' is set. States shorter than the poll interval may be missed",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"time": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Time (RFC 3339) the VM was first seen in the state",
+						},
+						"state": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "State of the VM, or its LCM state while it's ACTIVE",
+						},
+					},
+				},
+			},
+			"wait_for_lcm_state": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "RUNNING",
+				Description: "LCM state to wait for after creating the VM, e.g. RUNNING or HOTPLUG. A VM already RUNNING has passed PROLOG and BOOT",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if vmLcmState(v.(string)) == -1 {
+						errors = append(errors, fmt.Errorf("%q must be an LCM state of OpenNebula, got %s", k, v))
+					}
+
+					return
+				},
+			},
+			"wait_for_running": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Wait for the VM to reach wait_for_lcm_state after creating it. Otherwise the VM is left to boot on its own, so anything depending on it has to handle a VM that isn't running yet",
+			},
+			"auto_retry_on_failure": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "Times to retry booting the VM if it ends up in BOOT_FAILURE while creating it",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if v.(int) < 0 {
+						errors = append(errors, fmt.Errorf("%q can't be negative", k))
+					}
+
+					return
+				},
+			},
+			"desired_state": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Power state to keep the VM in: running, poweroff or undeployed",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if _, ok := vmPowerActions[v.(string)]; !ok {
+						errors = append(errors, fmt.Errorf("%q must be one of running, poweroff or undeployed", k))
+					}
+
+					return
+				},
+			},
+			"delete_action": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "terminate-hard",
+				Description: "Action run on the VM when the resource is destroyed: terminate-hard, terminate, or undeploy-hard or poweroff-hard to keep the VM around",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					if _, ok := vmDeleteStates[v.(string)]; !ok {
+						errors = append(errors, fmt.Errorf("%q must be one of terminate-hard, terminate, undeploy-hard or poweroff-hard", k))
+					}
+
+					return
+				},
+			},
 		},
 	}
 }
 
-func resourceVmCreate(d *schema.ResourceData, meta interface{}) error {
-	template := ""
-	nicArray := []string{}
-	diskArray := []string{}
+// Arguments rendering each template attribute OpenNebula may restrict to oneadmin
+var vmRestrictedAttrArgs = map[string]string{
+	"NIC/INBOUND_AVG_BW":    "network_bandwidth",
+	"NIC/INBOUND_PEAK_BW":   "network_bandwidth",
+	"NIC/INBOUND_PEAK_KB":   "network_bandwidth",
+	"NIC/OUTBOUND_AVG_BW":   "network_bandwidth",
+	"NIC/OUTBOUND_PEAK_BW":  "network_bandwidth",
+	"NIC/OUTBOUND_PEAK_KB":  "network_bandwidth",
+	"NIC/RAW":               "network_raw",
+	"DISK/RAW":              "image_raw",
+	"DISK/DEV_PREFIX":       "dev_prefix",
+	"CPU_COST":              "cpu_cost",
+	"MEMORY_COST":           "memory_cost",
+	"DISK_COST":             "disk_cost",
+	"PCI":                   "vgpu",
+	"SCHED_REQUIREMENTS":    "sched_requirements",
+	"SCHED_DS_REQUIREMENTS": "sched_ds_requirements",
+	"SECURITY_GROUPS":       "security_group_ids",
+}
+
+// validateRestrictedAttributes fails if a user outside the oneadmin group sets attributes
+// OpenNebula restricts to oneadmin, instead of letting instantiate or update fail
+func validateRestrictedAttributes(d *schema.ResourceDiff, meta interface{}) error {
+	client := meta.(*Client)
+
+	args := []string{}
+	for _, attr := range client.RestrictedAttributes {
+		arg, ok := vmRestrictedAttrArgs[attr]
+		if !ok || (d.Id() != "" && !d.HasChange(arg)) {
+			continue
+		}
+		if value, ok := d.GetOk(arg); ok {
+			if list, isList := value.([]interface{}); !isList || len(list) > 0 {
+				args = append(args, fmt.Sprintf("%q (%s)", arg, attr))
+			}
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	admin, err := client.IsAdmin()
+	if err != nil {
+		return fmt.Errorf("Could not tell whether user %s may set restricted attributes: %s", client.Username, err)
+	}
+	if !admin {
+		sort.Strings(args)
+		return fmt.Errorf("%s restricted to oneadmin, which user %s isn't in. Remove them, or disable 'check_restricted_attributes' if the restrictions were relaxed",
+			strings.Join(args, ", "), client.Username)
+	}
+
+	return nil
+}
+
+// Arguments each hypervisor can't honour, and why
+var vmHypervisorUnsupported = map[string]map[string]string{
+	"kvm": {},
+	"lxc": {
+		"vgpu":  "LXC containers can't be assigned PCI devices",
+		"input": "LXC containers have no graphical console",
+	},
+	"firecracker": {
+		"vgpu":                      "Firecracker microVMs don't support PCI passthrough",
+		"input":                     "Firecracker microVMs have no graphical console",
+		"detach_context_after_boot": "Firecracker microVMs can't be reconfigured with updateconf",
+	},
+	"vcenter": {
+		"detach_context_after_boot": "vCenter VMs get their context through VMware Tools rather than a CDROM",
+	},
+}
+
+// Image drivers each hypervisor can boot from, if it's restricted
+var vmHypervisorImageDrivers = map[string][]string{
+	"lxc":         {"raw"},
+	"firecracker": {"raw"},
+}
+
+func resourceVmCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	meta, err := vmClient(d.Get("endpoint").(string), meta)
+	if err != nil {
+		return err
+	}
+
+	if d.Get("hot_add_cpu").(bool) {
+		if err := validateHotAddCpu(d); err != nil {
+			return err
+		}
+	}
+
+	// without a declared maximum, the hypervisor can't resize a running VM
+	strategy := d.Get("resize_strategy").(string)
+	for _, arg := range []string{"vcpu", "memory"} {
+		max := d.Get(arg + "_max").(int)
+		if max > 0 && d.Get(arg).(int) > max {
+			return fmt.Errorf("%q %d exceeds %q %d", arg, d.Get(arg), arg+"_max", max)
+		}
+		if d.Id() != "" && d.HasChange(arg) && max == 0 {
+			if strategy == "live" {
+				return fmt.Errorf("%q can't be changed live without %q set on create, use %q poweroff or cold instead", arg, arg+"_max", "resize_strategy")
+			}
+			if strategy == "" {
+				if err := d.ForceNew(arg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// the CPU share can't be changed on a running VM at all
+	if d.Id() != "" && d.HasChange("cpu") {
+		if strategy == "live" {
+			return fmt.Errorf("%q can't be changed live, use %q poweroff or cold instead", "cpu", "resize_strategy")
+		}
+		if strategy == "" {
+			if err := d.ForceNew("cpu"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the NICs of nic blocks can't be reattached with other security groups
+	if d.Id() != "" && d.HasChange("security_group_ids") && len(d.Get("nic").([]interface{})) > 0 {
+		if err := d.ForceNew("security_group_ids"); err != nil {
+			return err
+		}
+	}
+
+	if d.NewValueKnown("template_id") && (d.Id() == "" || d.HasChange("user_inputs")) {
+		if err := validateUserInputs(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.Id() == "" || d.HasChange("data_disk") {
+		if err := validateDataDisks(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if err := validateRestrictedAttributes(d, meta); err != nil {
+		return err
+	}
+
+	if d.Id() == "" {
+		if _, ok := d.GetOk("network"); !ok && len(d.Get("nic").([]interface{})) == 0 && d.NewValueKnown("nic") {
+			if d.Get("boot_from_network").(bool) {
+				return fmt.Errorf("%q requires a NIC to boot from, set %q or %q", "boot_from_network", "network", "nic")
+			}
+			return fmt.Errorf("One of %q or %q is required", "network", "nic")
+		}
+		if err := validateDisks(d); err != nil {
+			return err
+		}
+		if err := validatePlacementMode(d); err != nil {
+			return err
+		}
+		if err := validateDeployDatastore(d, meta); err != nil {
+			return err
+		}
+		if err := validateReservationLeases(d, meta); err != nil {
+			return err
+		}
+		if err := validateNoWait(d); err != nil {
+			return err
+		}
+		if err := validateDeployHost(d, meta); err != nil {
+			return err
+		}
+		if err := validateVmQuotas(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.Get("os.0.firmware_secure").(bool) && d.Get("os.0.firmware").(string) != "UEFI" {
+		return fmt.Errorf("%q requires %q UEFI", "firmware_secure", "firmware")
+	}
+
+	if err := validateTopology(d); err != nil {
+		return err
+	}
+
+	if err := validateBootOrder(d); err != nil {
+		return err
+	}
+
+	if d.Get("graphics.0.type").(string) == "VNC" {
+		for _, arg := range []string{"tls_port", "sound", "usb_redirection"} {
+			if _, ok := d.GetOk("graphics.0." + arg); ok {
+				return fmt.Errorf("%q is only supported by SPICE graphics", arg)
+			}
+		}
+	}
+
+	if d.Id() != "" {
+		if err := customizeNetworkChange(d); err != nil {
+			return err
+		}
+	}
+
+	if d.Id() != "" && d.HasChange("size") && d.Get("image_readonly").(bool) && !d.HasChange("image_readonly") {
+		return fmt.Errorf("%q can't be changed, the disk is read-only", "size")
+	}
+	for i := range d.Get("disk").([]interface{}) {
+		size, readonly := fmt.Sprintf("disk.%d.size", i), fmt.Sprintf("disk.%d.readonly", i)
+		if d.Id() != "" && d.HasChange(size) && d.Get(readonly).(bool) && !d.HasChange(readonly) {
+			return fmt.Errorf("%q can't be changed, the disk is read-only", size)
+		}
+	}
+
+	hypervisor := d.Get("hypervisor").(string)
+	if hypervisor == "" {
+		return nil
+	}
+
+	for arg, reason := range vmHypervisorUnsupported[hypervisor] {
+		if value, ok := d.GetOk(arg); ok {
+			if list, isList := value.([]interface{}); !isList || len(list) > 0 {
+				return fmt.Errorf("%q is not supported by hypervisor %s: %s", arg, hypervisor, reason)
+			}
+		}
+	}
+
+	if drivers, ok := vmHypervisorImageDrivers[hypervisor]; ok {
+		if driver, ok := d.GetOk("image_driver"); ok {
+			supported := false
+			for _, supportedDriver := range drivers {
+				supported = supported || supportedDriver == driver.(string)
+			}
+			if !supported {
+				return fmt.Errorf("%q %s is not supported by hypervisor %s, use one of: %s",
+					"image_driver", driver, hypervisor, strings.Join(drivers, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateHotAddCpu makes sure VCPUs are only ever added to the guest, within the VCPU_MAX
+// the VM was created with, on a hypervisor that can hotplug them
+func validateHotAddCpu(d *schema.ResourceDiff) error {
+	if hypervisor := d.Get("hypervisor").(string); hypervisor != "" && hypervisor != "kvm" {
+		return fmt.Errorf("%q is not supported by hypervisor %s, use %q poweroff instead", "hot_add_cpu", hypervisor, "resize_strategy")
+	}
+	if d.NewValueKnown("vcpu_max") && d.Get("vcpu_max").(int) == 0 {
+		return fmt.Errorf("%q requires %q, the guest can't hotplug VCPUs without it. Use %q poweroff instead", "hot_add_cpu", "vcpu_max", "resize_strategy")
+	}
+
+	if d.Id() != "" && d.HasChange("vcpu") {
+		old, new := d.GetChange("vcpu")
+		if new.(int) < old.(int) {
+			return fmt.Errorf("%q can't remove VCPUs from the guest (%d to %d), use %q poweroff instead", "hot_add_cpu", old, new, "resize_strategy")
+		}
+	}
+
+	return nil
+}
+
+// validateNoWait rules out the steps of creating a VM which need it to be running, if it isn't waited for
+func validateNoWait(d *schema.ResourceDiff) error {
+	reason := "with 'wait_for_running' false"
+	if _, pinned := d.GetOkExists("host_id"); d.Get("on_hold").(bool) && !pinned {
+		reason = "it stays on hold without 'host_id'"
+	} else if d.Get("wait_for_running").(bool) {
+		return nil
+	}
+
+	for _, arg := range []string{"floating_ip", "wait_for_guest_agent", "detach_context_after_boot"} {
+		if _, ok := d.GetOk(arg); ok {
+			return fmt.Errorf("%q requires a running VM, which isn't waited for as %s", arg, reason)
+		}
+	}
+	if _, ok := d.GetOk("ip"); !ok && d.Get("set_hostname_from_dns").(bool) {
+		return fmt.Errorf("%q without %q requires a running VM, which isn't waited for as %s", "set_hostname_from_dns", "ip", reason)
+	}
+	if state := d.Get("desired_state").(string); state != "" && state != "running" {
+		return fmt.Errorf("%q %s requires a running VM, which isn't waited for as %s", "desired_state", state, reason)
+	}
+
+	return nil
+}
+
+// validateDeployHost makes sure the host the VM is deployed on exists and takes VMs. With
+// enforce_deploy_capacity, the CPU and memory set on the VM have to fit into what's left of it.
+func validateDeployHost(d *schema.ResourceDiff, meta interface{}) error {
+	var host *Host
+
+	hostId, pinned := d.GetOkExists("host_id")
+	if !pinned || !d.NewValueKnown("host_id") {
+		return nil
+	}
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.host.info", hostId.(int), false)
+	if oneErr, ok := err.(*OpenNebulaError); ok && oneErr.Code == errorNoExists {
+		return fmt.Errorf("Host %d of %q doesn't exist", hostId, "host_id")
+	}
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &host); err != nil {
+		return err
+	}
+
+	// disabled (4) and offline (8) hosts don't take new VMs
+	if host.State == 4 || host.State == 8 {
+		return fmt.Errorf("Host %s (%d) is disabled or offline", host.Name, host.Id)
+	}
+	if !d.Get("enforce_deploy_capacity").(bool) || host.HostShare == nil {
+		return nil
+	}
+
+	// CPU is in percent of a core and memory in KB on the host
+	if cpu, ok := d.GetOk("cpu"); ok && d.NewValueKnown("cpu") && cpu.(int)*100 > host.HostShare.MaxCpu-host.HostShare.CpuUsage {
+		return fmt.Errorf("Host %s (%d) has %d%% CPU left, not enough for %q %d (set enforce_deploy_capacity = false to overcommit the host)",
+			host.Name, host.Id, host.HostShare.MaxCpu-host.HostShare.CpuUsage, "cpu", cpu)
+	}
+	if memory, ok := d.GetOk("memory"); ok && d.NewValueKnown("memory") && memory.(int)*1024 > host.HostShare.MaxMem-host.HostShare.MemUsage {
+		return fmt.Errorf("Host %s (%d) has %d MB memory left, not enough for %q %d (set enforce_deploy_capacity = false to overcommit the host)",
+			host.Name, host.Id, (host.HostShare.MaxMem-host.HostShare.MemUsage)/1024, "memory", memory)
+	}
+
+	return nil
+}
+
+// validateBootOrder makes sure the boot order only lists devices the VM has. A device listed
+// twice only counts where it's listed first.
+func validateBootOrder(d *schema.ResourceDiff) error {
+	boot := d.Get("os.0.boot").(string)
+	if boot == "" || !d.NewValueKnown("os") || !d.NewValueKnown("data_disk") || !d.NewValueKnown("floating_ip") {
+		return nil
+	}
+
+	nics := 1
+	if n := len(d.Get("nic").([]interface{})); n > 0 {
+		nics = n
+	}
+	devices := map[string]int{
+		"disk": vmBootDisks(d.Get("disk").([]interface{}), d.Get("boot_from_network").(bool)) + len(d.Get("data_disk").([]interface{})),
+		"nic":  nics + len(d.Get("floating_ip").([]interface{})),
+	}
+	seen := map[string]bool{}
+	for _, device := range strings.Split(boot, ",") {
+		device = strings.TrimSpace(device)
+		if seen[device] {
+			log.Printf("[WARNING] Boot device %s is listed more than once in %q", device, boot)
+			continue
+		}
+		seen[device] = true
+
+		kind := strings.TrimRight(device, "0123456789")
+		index, err := strconv.Atoi(strings.TrimPrefix(device, kind))
+		count, known := devices[kind]
+		if err != nil || !known {
+			return fmt.Errorf("Boot device %q must be a disk or NIC with its index, e.g. disk0 or nic1", device)
+		}
+		if index >= count {
+			return fmt.Errorf("Boot device %s doesn't exist, the VM has %d %s devices (%s0 to %s%d)", device, count, kind, kind, kind, count-1)
+		}
+	}
+
+	return nil
+}
+
+// topologyVector renders the topology block as the TOPOLOGY vector, leaving out unset counts
+func topologyVector(topology map[string]interface{}) string {
+	attrs := map[string]string{"PIN_POLICY": topology["pin_policy"].(string)}
+	for arg, attr := range map[string]string{"sockets": "SOCKETS", "cores": "CORES", "threads": "THREADS"} {
+		if topology[arg].(int) > 0 {
+			attrs[attr] = strconv.Itoa(topology[arg].(int))
+		}
+	}
+	if topology["emulator_threads"].(string) != "" {
+		attrs["EMULATOR_THREADS"] = topology["emulator_threads"].(string)
+	}
+
+	return vectorString("TOPOLOGY", attrs)
+}
+
+// validateTopology makes sure emulator threads are only pinned along with the vCPUs, and a
+// complete topology adds up to the VCPU count
+func validateTopology(d *schema.ResourceDiff) error {
+	if _, ok := d.GetOk("topology"); !ok {
+		return nil
+	}
+
+	if d.Get("topology.0.emulator_threads").(string) != "" && d.Get("topology.0.pin_policy").(string) == "NONE" {
+		return fmt.Errorf("%q requires a %q other than NONE", "emulator_threads", "pin_policy")
+	}
+
+	sockets, cores, threads := d.Get("topology.0.sockets").(int), d.Get("topology.0.cores").(int), d.Get("topology.0.threads").(int)
+	if vcpu, ok := d.GetOk("vcpu"); ok && d.NewValueKnown("vcpu") && sockets > 0 && cores > 0 && threads > 0 {
+		if sockets*cores*threads != vcpu.(int) {
+			return fmt.Errorf("%q of %d sockets, %d cores and %d threads doesn't match %q %d", "topology", sockets, cores, threads, "vcpu", vcpu)
+		}
+	}
+
+	return nil
+}
+
+// customizeNetworkChange lets a new network take the IP along to it, if it's preserved or
+// changed at the same time. The NIC and its addresses are read back after the reattach.
+func customizeNetworkChange(d *schema.ResourceDiff) error {
+	if !d.HasChange("network") {
+		if d.HasChange("ip") {
+			return d.ForceNew("ip")
+		}
+		return nil
+	}
+
+	computed := []string{"network_gateway", "network_dns", "network_mac", "network_parent_id"}
+	if !d.HasChange("ip") && !d.Get("preserve_ip").(bool) {
+		computed = append(computed, "ip")
+	}
+	for _, arg := range computed {
+		if err := d.SetNewComputed(arg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourceVmCreate(d *schema.ResourceData, meta interface{}) error {
+	meta, err := vmClient(d.Get("endpoint").(string), meta)
+	if err != nil {
+		return err
+	}
+
+	template := ""
+	nicArray := []string{}
+	diskArray := []string{}
+	client := meta.(*Client)
+
+	// build NIC template, one per nic block or the one of network
+	if value, ok := d.GetOk("security_group_ids"); ok {
+		// kept in the user template as well, to tell them from the ones of the NIC
+		template += fmt.Sprintf("SECURITY_GROUPS = \"%s\"\n", idListString(value.([]interface{})))
+	}
+	if nics := d.Get("nic").([]interface{}); len(nics) > 0 {
+		for _, v := range nics {
+			template += nicVector(v.(map[string]interface{}), d.Get("security_group_ids").([]interface{}))
+		}
+	} else {
+		nicArray = networkNicArray(d)
+		if value, ok := d.GetOk("ip"); ok {
+			nicArray = append(nicArray, fmt.Sprintf("IP=\"%s\"", value))
+		}
+
+		template += "NIC = [\n " + strings.Join(nicArray, ",\n ") + " ]\n"
+	}
+
+	// build the disk part of the template
+	diskArray = append(diskArray, fmt.Sprintf("SIZE=\"%d\"", d.Get("size")))
+	if value, ok := d.GetOk("image"); ok {
+		diskArray = append(diskArray, fmt.Sprintf("IMAGE=\"%s\"", value))
+	} else if value, ok := d.GetOkExists("image_id"); ok {
+		diskArray = append(diskArray, fmt.Sprintf("IMAGE_ID=\"%d\"", value))
+	}
+	if value, ok := d.GetOk("image_uname"); ok {
+		diskArray = append(diskArray, fmt.Sprintf("IMAGE_UNAME=\"%s\"", value))
+	}
+	if value, ok := d.GetOk("image_driver"); ok {
+		diskArray = append(diskArray, fmt.Sprintf("IMAGE_DRIVER=\"%s\"", value))
+	}
+	if d.Get("image_clone").(bool) {
+		diskArray = append(diskArray, "CLONE=\"YES\"")
+	}
+	if d.Get("image_readonly").(bool) {
+		diskArray = append(diskArray, "READONLY=\"YES\"")
+	}
+	if value, ok := d.GetOk("image_raw"); ok {
+		diskArray = append(diskArray, fmt.Sprintf("RAW=\"%s\"", escapeTemplateValue(value.(string))))
+	}
+	if value, ok := d.GetOk("dev_prefix"); ok {
+		diskArray = append(diskArray, fmt.Sprintf("DEV_PREFIX=\"%s\"", value))
+	}
+
+	if name := d.Get("name").(string); name != "" {
+		if err := checkDuplicateVmName(d, client, name); err != nil {
+			return err
+		}
+	}
+
+	// a persistent clone boots from the copy of the first image of the template, unless another one is set
+	templateId := d.Get("template_id").(int)
+	if d.Get("persistent_clone").(bool) {
+		cloneId, imageIds, err := clonePersistentTemplate(d, client)
+		if err != nil {
+			return err
+		}
+		templateId = cloneId
+		// without a VM the copies would outlive the failed create
+		defer func() {
+			if d.Id() == "" {
+				deleteClonedTemplate(client, cloneId)
+			}
+		}()
+
+		_, byName := d.GetOk("image")
+		_, byId := d.GetOkExists("image_id")
+		if !byName && !byId && len(imageIds) > 0 {
+			diskArray = append(diskArray, fmt.Sprintf("IMAGE_ID=\"%d\"", imageIds[0]))
+		}
+	}
+
+	if disks := d.Get("disk").([]interface{}); len(disks) > 0 {
+		for _, v := range disks {
+			template += diskVector(v.(map[string]interface{}), d.Get("dev_prefix").(string))
+		}
+	} else if !d.Get("boot_from_network").(bool) {
+		template += "DISK = [\n " + strings.Join(diskArray, ",\n ") + " ]\n"
+	}
+
+	for _, v := range d.Get("data_disk").([]interface{}) {
+		template += dataDiskVector(v.(map[string]interface{}), d.Get("dev_prefix").(string))
+	}
+
+	// add cpus if requested
+	if value, ok := d.GetOk("cpu"); ok {
+		template += fmt.Sprintf("CPU = \"%d\"\n", value)
+	}
+
+	// add vcpu if requested
+	if value, ok := d.GetOk("vcpu"); ok {
+		template += fmt.Sprintf("VCPU = \"%d\"\n", value)
+	}
+
+	// add memory if requested
+	if value, ok := d.GetOk("memory"); ok {
+		template += fmt.Sprintf("MEMORY = \"%d\"\n", value)
+	}
+
+	// declare the limits of live resizes
+	if value, ok := d.GetOk("vcpu_max"); ok {
+		template += fmt.Sprintf("VCPU_MAX = \"%d\"\n", value)
+	}
+	if value, ok := d.GetOk("memory_max"); ok {
+		template += fmt.Sprintf("MEMORY_MAX = \"%d\"\n", value)
+	}
+	if value, ok := d.GetOk("memory_slots"); ok {
+		template += fmt.Sprintf("MEMORY_SLOTS = \"%d\"\n", value)
+	}
+	hotResize := map[string]string{}
+	if _, ok := d.GetOk("vcpu_max"); ok {
+		hotResize["CPU_HOT_ADD_ENABLED"] = "YES"
+	}
+	if _, ok := d.GetOk("memory_max"); ok {
+		hotResize["MEMORY_HOT_ADD_ENABLED"] = "YES"
+	}
+	if len(hotResize) > 0 {
+		template += vectorString("HOT_RESIZE", hotResize)
+	}
+
+	// translate the affinity to other VMs into scheduling requirements
+	if value, ok := d.GetOk("affinity"); ok {
+		affinity := value.([]interface{})[0].(map[string]interface{})
+		vmIds := []int{}
+		for _, id := range affinity["vm_ids"].([]interface{}) {
+			vmIds = append(vmIds, id.(int))
+		}
+		template += fmt.Sprintf("SCHED_REQUIREMENTS = \"%s\"\n", affinityRequirements(affinity["policy"].(string), vmIds))
+	}
+
+	if value, ok := d.GetOk("sched_requirements"); ok {
+		template += fmt.Sprintf("SCHED_REQUIREMENTS = \"%s\"\n", escapeTemplateValue(value.(string)))
+	}
+
+	if value, ok := d.GetOk("sched_ds_requirements"); ok {
+		template += fmt.Sprintf("SCHED_DS_REQUIREMENTS = \"%s\"\n", escapeTemplateValue(value.(string)))
+	}
+
+	// a VM left over from a lost state is adopted by importing it, not duplicated
+	if value, ok := d.GetOk("external_id"); ok {
+		vm, err := vmByExternalId(client, value.(string))
+		if err != nil {
+			return err
+		}
+		if vm != nil {
+			return fmt.Errorf("VM %s has external_id %s already, import it with 'terraform import <address> external_id:%s'", vm.Id, value, value)
+		}
+		template += fmt.Sprintf("EXTERNAL_ID = \"%s\"\n", escapeTemplateValue(value.(string)))
+	}
+
+	// costs not set here are left to the VM template
+	for k, attr := range vmCostAttrs {
+		if value, ok := d.GetOk(k); ok {
+			template += fmt.Sprintf("%s = \"%s\"\n", attr, strconv.FormatFloat(value.(float64), 'f', -1, 64))
+		}
+	}
+
+	if value, ok := d.GetOk("graphics"); ok {
+		template += graphicsVector(value.([]interface{})[0].(map[string]interface{}))
+	}
+
+	if value, ok := d.GetOk("os"); ok {
+		osAttrs, err := templateVector(client, d.Get("template_id").(int), "OS")
+		if err != nil {
+			return err
+		}
+		// the boot order of the os block takes precedence
+		if d.Get("boot_from_network").(bool) {
+			osAttrs["BOOT"] = "nic0"
+		}
+		template += osVector(osAttrs, value.([]interface{})[0].(map[string]interface{}))
+	} else if d.Get("boot_from_network").(bool) {
+		osAttrs, err := templateVector(client, d.Get("template_id").(int), "OS")
+		if err != nil {
+			return err
+		}
+		osAttrs["BOOT"] = "nic0"
+		template += vectorString("OS", osAttrs)
+	}
+
+	for _, v := range d.Get("input").([]interface{}) {
+		input := v.(map[string]interface{})
+		template += vectorString("INPUT", map[string]string{"TYPE": input["type"].(string), "BUS": input["bus"].(string)})
+	}
+
+	// add the mediated GPU devices
+	for _, v := range d.Get("vgpu").([]interface{}) {
+		vgpu := v.(map[string]interface{})
+		pciArray := []string{
+			fmt.Sprintf("DEVICE=\"%s\"", vgpu["device"]),
+			fmt.Sprintf("PROFILE=\"%s\"", vgpu["profile"]),
+		}
+		if vgpu["vendor"].(string) != "" {
+			pciArray = append(pciArray, fmt.Sprintf("VENDOR=\"%s\"", vgpu["vendor"]))
+		}
+		template += "PCI = [\n " + strings.Join(pciArray, ",\n ") + " ]\n"
+	}
+
+	if value, ok := d.GetOk("topology"); ok {
+		template += topologyVector(value.([]interface{})[0].(map[string]interface{}))
+	}
+
+	// the VM template refers to the values of its user inputs as $NAME
+	for k, v := range d.Get("user_inputs").(map[string]interface{}) {
+		template += fmt.Sprintf("%s = \"%s\"\n", k, escapeTemplateValue(v.(string)))
+	}
+
+	// custom attributes end up in the user template
+	for k, v := range d.Get("metadata").(map[string]interface{}) {
+		template += fmt.Sprintf("%s = \"%s\"\n", k, escapeTemplateValue(v.(string)))
+	}
+
+	// schedule the termination of the VM
+	terminateAt := time.Time{}
+	if value, ok := d.GetOk("ttl"); ok {
+		ttl, _ := time.ParseDuration(value.(string))
+		terminateAt = time.Now().Add(ttl)
+	} else if value, ok := d.GetOk("terminate_at"); ok {
+		terminateAt, _ = time.Parse(time.RFC3339, value.(string))
+	}
+	if !terminateAt.IsZero() {
+		template += fmt.Sprintf("SCHED_ACTION = [\n ACTION=\"terminate\",\n TIME=\"%d\" ]\n", terminateAt.Unix())
+	}
+
+	for _, v := range d.Get("sched_action").([]interface{}) {
+		template += schedActionTemplate(v.(map[string]interface{}))
+	}
+
+	// context attributes to add to the ones of the VM template
+	context := map[string]string{}
+
+	if value, ok := d.GetOk("context_target"); ok {
+		context["TARGET"] = value.(string)
+	}
+
+	for k, v := range d.Get("context").(map[string]interface{}) {
+		context[k] = v.(string)
+	}
+
+	if value, ok := d.GetOk("ssh_public_key"); ok {
+		context["SSH_PUBLIC_KEY"] = value.(string)
+	}
+
+	if value, ok := d.GetOk("start_script"); ok {
+		context["START_SCRIPT_BASE64"] = base64.StdEncoding.EncodeToString([]byte(value.(string)))
+	}
+
+	if value, ok := d.GetOk("network_context"); ok {
+		for k, v := range nicContext(0, value.([]interface{})[0].(map[string]interface{})) {
+			context[k] = v
+		}
+	}
+	for k, v := range nicBlocksContext(d.Get("nic").([]interface{})) {
+		context[k] = v
+	}
+
+	// with a static IP, the hostname is known before the VM boots
+	if d.Get("set_hostname_from_dns").(bool) {
+		// an unnamed VM without a PTR record keeps the hostname its image gives it
+		if ip, ok := d.GetOk("ip"); ok {
+			if hostname := hostnameForIp(ip.(string), d.Get("name").(string)); hostname != "" {
+				context["SET_HOSTNAME"] = hostname
+			}
+		}
+	}
+
+	if len(context) > 0 {
+		templateCtx, err := templateVector(client, d.Get("template_id").(int), "CONTEXT")
+		if err != nil {
+			return err
+		}
+		for k, v := range context {
+			templateCtx[k] = v
+		}
+		template += vectorString("CONTEXT", templateCtx)
+	}
+
+	// a VM pinned to a host is held, so the scheduler doesn't deploy it elsewhere first
+	hostId, pinned := d.GetOkExists("host_id")
+	if d.Get("placement_mode").(string) == "manual" && !pinned {
+		return fmt.Errorf("%q manual requires %q", "placement_mode", "host_id")
+	}
+
+	onHold := d.Get("on_hold").(bool)
+	resp, err := client.Call(
+		"one.template.instantiate",
+		templateId,
+		d.Get("name"),
+		pinned || onHold,
+		//todo: maybe use backticks
+		template,
+		false,
+	)
+	if err != nil {
+		if d.Get("persistent_clone").(bool) {
+			return fmt.Errorf("Error instantiating template %d cloned from template %d: %s", templateId, d.Get("template_id"), err)
+		}
+		return err
+	}
+
+	d.SetId(resp)
+	d.Set("template_inherited", templateInherited(d, vmTemplateArgs))
+
+	if pinned {
+		if err = deployVm(d, client, hostId.(int)); err != nil {
+			return err
+		}
+	}
+
+	// the steps depending on a running VM are ruled out on plan if it isn't waited for
+	if d.Get("wait_for_running").(bool) && (pinned || !onHold) {
+		lcmState := d.Get("wait_for_lcm_state").(string)
+		_, err = waitForVmState(d, meta, lcmState)
+		for retry := 1; err == errVmBootFailure && retry <= d.Get("auto_retry_on_failure").(int); retry++ {
+			log.Printf("[WARNING] VM %s failed to boot, retrying (%d of %d)", d.Id(), retry, d.Get("auto_retry_on_failure"))
+			if _, err = client.Call("one.vm.recover", intId(d.Id()), 2); err != nil { // 2: retry
+				return err
+			}
+			_, err = waitForVmState(d, meta, lcmState)
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"Error waiting for virtual machine (%s) to be in LCM state %s: %s", d.Id(), lcmState, err)
+		}
+	}
+
+	// otherwise the VM keeps the permissions OpenNebula gave it
+	if d.Get("manage_permissions").(bool) {
+		if _, ok := d.GetOk("permissions"); !ok {
+			d.Set("permissions", "640")
+		}
+
+		if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vm.chmod"); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range d.Get("floating_ip").([]interface{}) {
+		floatingIp := v.(map[string]interface{})
+		if err = attachFloatingIp(d, meta, floatingIp["network"].(string), floatingIp["ip"].(string)); err != nil {
+			return err
+		}
+	}
+
+	// otherwise the guest only picks up its hostname on its next boot
+	if _, ok := d.GetOk("ip"); !ok && d.Get("set_hostname_from_dns").(bool) {
+		if err = resourceVmSetHostnameFromDns(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.Get("wait_for_guest_agent").(bool) {
+		if err = waitForGuestAgent(d, meta, false); err != nil {
+			return err
+		}
+	}
+
+	if d.Get("detach_context_after_boot").(bool) {
+		if err = resourceVmDetachContext(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if value, ok := d.GetOk("desired_state"); ok && value.(string) != "running" {
+		if err = changeVmPowerState(d, meta, value.(string)); err != nil {
+			return err
+		}
+	}
+
+	return resourceVmRead(d, meta)
+}
+
+func resourceVmRead(d *schema.ResourceData, meta interface{}) error {
+	meta, err := vmClient(d.Get("endpoint").(string), meta)
+	if err != nil {
+		return err
+	}
+
+	var vm *UserVm
+	var vms *UserVms
+
+	client := meta.(*Client)
+	found := false
+	name := d.Get("name").(string)
+	if name == "" {
+		name = d.Get("instance").(string)
+	}
+
+	// Once created, the VM is only read by ID: names aren't unique, so another VM could take its place
+	if d.Id() != "" {
+		resp, err := client.Call("one.vm.info", intId(d.Id()))
+		if oneErr, ok := err.(*OpenNebulaError); ok && oneErr.Code == errorNoExists {
+			log.Printf("Could not find VM by ID %s", d.Id())
+			d.SetId("")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		found = true
+		if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+			return err
+		}
+	}
+
+	// A VM created without a name only has the name OpenNebula assigned, which can't be searched for
+	if !found && name == "" {
+		log.Printf("Could not find unnamed vm for user %s", client.Username)
+		return nil
+	}
+
+	// Otherwise, try to find the vm by (user, name) as the de facto compound primary key
+	if !found {
+		resp, err := client.Call("one.vmpool.info", -3, -1, -1)
+		if err != nil {
+			return err
+		}
+
+		if err = xml.Unmarshal([]byte(resp), &vms); err != nil {
+			return err
+		}
+
+		for _, v := range vms.UserVm {
+			if v.Name == name {
+				vm = v
+				found = true
+				break
+			}
+		}
+
+		if !found || vm == nil {
+			d.SetId("")
+			log.Printf("Could not find vm with name %s for user %s", name, client.Username)
+			return nil
+		}
+	}
+
+	d.SetId(vm.Id)
+	// imported or minimal VMs may have no disk, NIC or context, their arguments are read as empty
+	if vm.VmTemplate == nil {
+		vm.VmTemplate = &VmTemplate{}
+	}
+	if vm.VmTemplate.Context == nil {
+		vm.VmTemplate.Context = &Context{Attributes: map[string]string{}}
+	}
+	disk := vm.VmTemplate.Disk()
+	// the disks of a VM booting from the network are all data disks
+	if disk == nil || d.Get("boot_from_network").(bool) {
+		disk = &Disk{}
+	}
+	nic := vm.VmTemplate.Nic()
+	if nic == nil {
+		nic = &Nic{}
+	}
+	inherited := map[string]bool{}
+	for _, arg := range d.Get("template_inherited").([]interface{}) {
+		inherited[arg.(string)] = true
+	}
+	d.Set("instance", vm.Name)
+	d.Set("uid", vm.Uid)
+	d.Set("gid", vm.Gid)
+	d.Set("uname", vm.Uname)
+	d.Set("gname", vm.Gname)
+	d.Set("state", vm.State)
+	d.Set("lcmstate", vm.LcmState)
+	d.Set("deploy_id", vm.DeployId)
+	snapshots := []map[string]interface{}{}
+	for _, snapshot := range vm.VmTemplate.Snapshots {
+		snapshots = append(snapshots, map[string]interface{}{
+			"id":   snapshot.Id,
+			"name": snapshot.Name,
+			"time": time.Unix(snapshot.Time, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	d.Set("snapshots", snapshots)
+	if powerState, ok := vmPowerStates[vm.State]; ok {
+		d.Set("desired_state", powerState)
+	}
+	// a persistent clone is instantiated from the copy rather than the configured template
+	if !d.Get("persistent_clone").(bool) || vm.VmTemplate.TemplateId != d.Get("cloned_template_id").(int) {
+		d.Set("template_id", vm.VmTemplate.TemplateId)
+	}
+	// the last deployment is the current one
+	if len(vm.History) > 0 {
+		d.Set("host_id", vm.History[len(vm.History)-1].Hid)
+		d.Set("deploy_datastore_id", vm.History[len(vm.History)-1].DsId)
+	}
+	d.Set("cpu", vm.VmTemplate.Cpu)
+	d.Set("vcpu", vm.VmTemplate.Vcpu)
+	d.Set("memory", vm.VmTemplate.Memory)
+	d.Set("vcpu_max", vm.VmTemplate.VcpuMax)
+	d.Set("memory_max", vm.VmTemplate.MemoryMax)
+	d.Set("memory_slots", vm.VmTemplate.MemorySlots)
+	d.Set("image", disk.Image)
+	// the image backing a disk can't change, unless someone swapped it outside of Terraform
+	if imageId, ok := d.GetOk("image_id"); ok && imageId.(int) != disk.ImageId {
+		log.Printf("[WARNING] The disk of VM %s is backed by image %d instead of %d now", vm.Id, disk.ImageId, imageId)
+	}
+	d.Set("image_id", disk.ImageId)
+	d.Set("size", disk.Size)
+	d.Set("image_driver", disk.ImageDriver)
+	d.Set("image_uname", disk.ImageUname)
+	// disk blocks read the attributes of their disk themselves
+	if len(d.Get("disk").([]interface{})) == 0 {
+		d.Set("image_readonly", disk.ReadOnly == "YES")
+		d.Set("image_raw", disk.Raw)
+	}
+	d.Set("dev_prefix", disk.DevPrefix)
+	d.Set("data_disk", readDataDisks(d, vm.VmTemplate.Disks))
+	if _, ok := d.GetOk("disk"); ok {
+		d.Set("disk", readDisks(d, vm.VmTemplate.Disks))
+	}
+	if _, ok := d.GetOk("nic"); ok {
+		d.Set("nic", readNics(d, client, vm.VmTemplate.Nics, vm.VmTemplate.Context))
+	}
+	d.Set("network_uname", nic.NetworkUname)
+	d.Set("network_search_domain", nic.NetworkSearchDomain)
+	d.Set("network_raw", nic.Raw)
+	d.Set("network_bandwidth", readNicBandwidth(nic))
+	securityGroupIds := parseIdList(nic.SecurityGroups)
+	if len(securityGroupIds) > 0 {
+		d.Set("security_group_id", securityGroupIds[0])
+	} else {
+		d.Set("security_group_id", 0)
+	}
+	d.Set("network_security_group_ids", securityGroupIds)
+	d.Set("network", nic.Network)
+	d.Set("network_mac", nic.Mac)
+	// without a lease, there's no address range to read the routing of
+	if nic.Network == "" || nic.Mac == "" {
+		d.Set("network_gateway", "")
+		d.Set("network_dns", "")
+		d.Set("network_parent_id", -1)
+	} else if vnet, err := client.vnetAddressRanges(nic.NetworkId); err == nil {
+		gateway, dns := vnet.Routing(nic.ArId)
+		d.Set("network_gateway", gateway)
+		d.Set("network_dns", dns)
+		d.Set("network_parent_id", -1)
+		if parentId, err := strconv.Atoi(vnet.ParentNetworkId); err == nil {
+			d.Set("network_parent_id", parentId)
+		}
+	} else {
+		log.Printf("[WARNING] Could not read the gateway and DNS of vnet %s: %s", nic.Network, err)
+	}
+	d.Set("floating_ip", floatingIps(vm.VmTemplate.Nics))
+	d.Set("ip", vm.VmTemplate.Context.IP)
+	d.Set("context_target", vm.VmTemplate.Context.Attributes["TARGET"])
+	// only the attributes managed through context, the context holds many others
+	context := map[string]interface{}{}
+	for k := range d.Get("context").(map[string]interface{}) {
+		if v, ok := vm.VmTemplate.Context.Attributes[k]; ok {
+			context[k] = v
+		}
+	}
+	d.Set("context", context)
+	d.Set("ssh_public_key", vm.VmTemplate.Context.Attributes["SSH_PUBLIC_KEY"])
+	startScript := vm.VmTemplate.Context.Attributes["START_SCRIPT"]
+	if encoded, ok := vm.VmTemplate.Context.Attributes["START_SCRIPT_BASE64"]; ok {
+		if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			startScript = string(decoded)
+		}
+	}
+	d.Set("start_script", startScript)
+	// OpenNebula fills these from the virtual network as well, so they're only read when set here
+	if _, ok := d.GetOk("network_context"); ok {
+		d.Set("network_context", []map[string]interface{}{readNicContext(0, vm.VmTemplate.Context.Attributes)})
+	}
+	d.Set("guest_network", readGuestNetwork(vm.VmTemplate.Context.Attributes))
+	d.Set("permissions", permissionString(vm.Permissions))
+	d.Set("full_template", "<TEMPLATE>"+vm.VmTemplate.Raw+"</TEMPLATE>")
+	d.Set("error_message", "")
+	if vm.VmUserTemplate != nil {
+		d.Set("error_message", vm.VmUserTemplate.Error)
+		d.Set("external_id", vm.VmUserTemplate.ExternalId)
+		if vm.VmUserTemplate.Error != "" {
+			log.Printf("[WARNING] VM %s has an error: %s", vm.Id, vm.VmUserTemplate.Error)
+		}
+		d.Set("security_group_ids", parseIdList(vm.VmUserTemplate.Vector.Map()["SECURITY_GROUPS"]))
+		d.Set("sched_requirements", vm.VmUserTemplate.SchedRequirements)
+		if !inherited["sched_ds_requirements"] {
+			d.Set("sched_ds_requirements", vm.VmUserTemplate.SchedDsRequirements)
+		}
+		d.Set("sched_message", vm.VmUserTemplate.SchedMessage)
+		if vm.VmUserTemplate.SchedMessage != "" {
+			log.Printf("[WARNING] The scheduler can't place VM %s: %s", vm.Id, vm.VmUserTemplate.SchedMessage)
+		}
+
+		// only the attributes managed through metadata, the user template holds many others
+		attrs := vm.VmUserTemplate.Vector.Map()
+		metadata := map[string]interface{}{}
+		for k := range d.Get("metadata").(map[string]interface{}) {
+			if v, ok := attrs[k]; ok {
+				metadata[k] = v
+			}
+		}
+		d.Set("metadata", metadata)
+	}
+	if err := readVmCosts(d, vm); err != nil {
+		return err
+	}
+	vgpus := []map[string]interface{}{}
+	for _, pci := range vm.VmTemplate.Pci {
+		if pci.Profile != "" {
+			vgpus = append(vgpus, map[string]interface{}{
+				"device":  pci.Device,
+				"vendor":  pci.Vendor,
+				"profile": pci.Profile,
+			})
+		}
+	}
+	if !inherited["vgpu"] {
+		d.Set("vgpu", vgpus)
+	}
+	if topology := vm.VmTemplate.Topology; topology != nil && !inherited["topology"] {
+		d.Set("topology", []map[string]interface{}{{
+			"pin_policy":       topology.PinPolicy,
+			"sockets":          topology.Sockets,
+			"cores":            topology.Cores,
+			"threads":          topology.Threads,
+			"emulator_threads": topology.EmulatorThreads,
+		}})
+	}
+	if vmOs := vm.VmTemplate.Os; vmOs != nil {
+		firmware := "BIOS"
+		if vmOs.Firmware != "" && vmOs.Firmware != "BIOS" {
+			// OpenNebula also accepts the path of an OVMF image for UEFI
+			firmware = "UEFI"
+		}
+		d.Set("os", []map[string]interface{}{{
+			"firmware":        firmware,
+			"firmware_secure": strings.ToUpper(vmOs.FirmwareSecure) == "YES",
+			"boot":            vmOs.Boot,
+		}})
+	}
+	inputs := []map[string]interface{}{}
+	for _, input := range vm.VmTemplate.Inputs {
+		inputs = append(inputs, map[string]interface{}{"type": input.Type, "bus": input.Bus})
+	}
+	if !inherited["input"] {
+		d.Set("input", inputs)
+	}
+	if graphics := vm.VmTemplate.Graphics; graphics != nil {
+		d.Set("graphics", []map[string]interface{}{{
+			"type":            strings.ToUpper(graphics.Type),
+			"listen":          graphics.Listen,
+			"port":            graphics.Port,
+			"keymap":          graphics.Keymap,
+			"tls_port":        graphics.TlsPort,
+			"sound":           graphics.Sound == "YES",
+			"usb_redirection": graphics.UsbRedirection,
+			// OpenNebula doesn't return the password
+			"passwd": d.Get("graphics.0.passwd").(string),
+		}})
+	}
+	d.Set("terminate_at", "")
+	for _, action := range vmSchedActions(vm) {
+		if action.Action == "terminate" || action.Action == "terminate-hard" {
+			d.Set("terminate_at", time.Unix(action.Time, 0).UTC().Format(time.RFC3339))
+			break
+		}
+	}
+	if err := d.Set("sched_action", readSchedActions(d, vm)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Arguments the template of the VM may set as well. The ones left unset on create are recorded in
+// template_inherited and not read, as the VM's value may be the template's. Other arguments the
+// template may set (cpu, memory, graphics, ...) are computed and can be read either way. The
+// ForceNew ones are computed too, so the values read for a VM created before template_inherited
+// don't replace it.
+var vmTemplateArgs = []string{"input", "vgpu", "topology", "sched_ds_requirements"}
+
+// templateInherited returns the arguments which are still unset
+func templateInherited(d *schema.ResourceData, args []string) []string {
+	unset := []string{}
+	for _, arg := range args {
+		if _, ok := d.GetOk(arg); !ok {
+			unset = append(unset, arg)
+		}
+	}
+
+	return unset
+}
+
+// vmSchedActions returns the scheduled actions of the VM, wherever this OpenNebula version stores them
+func vmSchedActions(vm *UserVm) []*SchedAction {
+	actions := []*SchedAction{}
+	if vm.VmTemplate != nil {
+		actions = append(actions, vm.VmTemplate.SchedActions...)
+	}
+	if vm.VmUserTemplate != nil {
+		actions = append(actions, vm.VmUserTemplate.SchedActions...)
+	}
+
+	return actions
+}
+
+// idListString renders IDs as the comma separated list OpenNebula uses, the reverse of parseIdList
+func idListString(ids []interface{}) string {
+	list := []string{}
+	for _, id := range ids {
+		list = append(list, strconv.Itoa(id.(int)))
+	}
+
+	return strings.Join(list, ",")
+}
+
+// parseIdList parses a comma separated list of IDs, as OpenNebula stores e.g. SECURITY_GROUPS
+func parseIdList(list string) []int {
+	ids := []int{}
+	for _, id := range strings.Split(list, ",") {
+		if i, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+			ids = append(ids, i)
+		}
+	}
+
+	return ids
+}
+
+// networkNicArray returns the attributes of the NIC of the network arguments, except for its IP
+func networkNicArray(d *schema.ResourceData) []string {
+	nicArray := []string{fmt.Sprintf("NETWORK=\"%s\"", d.Get("network"))}
+	if value, ok := d.GetOk("network_uname"); ok {
+		nicArray = append(nicArray, fmt.Sprintf("NETWORK_UNAME=\"%s\"", value))
+	}
+	if value, ok := d.GetOk("network_search_domain"); ok {
+		nicArray = append(nicArray, fmt.Sprintf("SEARCH_DOMAIN=\"%s\"", value))
+	}
+	if securityGroups := nicSecurityGroups(d); securityGroups != "" {
+		nicArray = append(nicArray, fmt.Sprintf("SECURITY_GROUPS=\"%s\"", securityGroups))
+	}
+	if value, ok := d.GetOk("network_raw"); ok {
+		nicArray = append(nicArray, fmt.Sprintf("RAW=\"%s\"", escapeTemplateValue(value.(string))))
+	}
+
+	return append(nicArray, nicBandwidth(d)...)
+}
+
+// nicSecurityGroups returns the security groups of the NIC followed by the ones of the whole VM
+func nicSecurityGroups(d *schema.ResourceData) string {
+	ids := []interface{}{}
+	seen := map[int]bool{}
+	if value, ok := d.GetOk("security_group_id"); ok {
+		ids = append(ids, value)
+		seen[value.(int)] = true
+	}
+	for _, id := range d.Get("security_group_ids").([]interface{}) {
+		if !seen[id.(int)] {
+			ids = append(ids, id)
+			seen[id.(int)] = true
+		}
+	}
+
+	return idListString(ids)
+}
+
+// affinityRequirements builds a SCHED_REQUIREMENTS expression matching the hosts
+// which run all the given VMs (affinity) or none of them (anti-affinity)
+func affinityRequirements(policy string, vmIds []int) string {
+	conditions := []string{}
+	for _, id := range vmIds {
+		if policy == "affinity" {
+			conditions = append(conditions, fmt.Sprintf("CURRENT_VMS = %d", id))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("CURRENT_VMS != %d", id))
+		}
+	}
+
+	return strings.Join(conditions, " & ")
+}
+
+// User template attributes set by OpenNebula or managed through their own arguments, which
+// therefore aren't imported as metadata
+var vmUserTemplateReserved = map[string]bool{
+	"SCHED_REQUIREMENTS":    true,
+	"SCHED_DS_REQUIREMENTS": true,
+	"SCHED_RANK":            true,
+	"SCHED_DS_RANK":         true,
+	"SCHED_MESSAGE":         true,
+	"ERROR":                 true,
+	"EXTERNAL_ID":           true,
+	"SECURITY_GROUPS":       true,
+	"CPU_COST":              true,
+	"MEMORY_COST":           true,
+	"DISK_COST":             true,
+}
+
+// resourceVmImportState reconstructs the arguments a read can't tell apart from the ones
+// that aren't configured, so that importing a VM results in no diff against its configuration
+func resourceVmImportState(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	var vm *UserVm
+	client := meta.(*Client)
+
+	if externalId := strings.TrimPrefix(d.Id(), "external_id:"); externalId != d.Id() {
+		found, err := vmByExternalId(client, externalId)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, fmt.Errorf("Could not find VM with external_id %s to import", externalId)
+		}
+		d.SetId(found.Id)
+	}
+
+	resp, err := client.Call("one.vm.info", intId(d.Id()))
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return nil, err
+	}
+
+	d.Set("name", vm.Name)
+	// only used on create, so there's nothing to read them from
+	d.Set("wait_for_lcm_state", "RUNNING")
+	d.Set("manage_permissions", true)
+	d.Set("auto_retry_on_failure", 0)
+	d.Set("enforce_deploy_capacity", true)
+	d.Set("guest_agent_timeout", "5m")
+
+	if vm.VmUserTemplate != nil {
+		metadata := map[string]interface{}{}
+		for k, v := range vm.VmUserTemplate.Vector.Map() {
+			if !vmUserTemplateReserved[k] {
+				metadata[k] = v
+			}
+		}
+		d.Set("metadata", metadata)
+
+		if policy, vmIds, ok := parseAffinityRequirements(vm.VmUserTemplate.SchedRequirements); ok {
+			d.Set("affinity", []map[string]interface{}{{"policy": policy, "vm_ids": vmIds}})
+		}
+	}
+
+	if err = resourceVmRead(d, meta); err != nil {
+		return nil, err
+	}
+	if d.Id() == "" {
+		return nil, fmt.Errorf("Could not find VM %s to import", vm.Id)
+	}
+
+	return []*schema.ResourceData{d}, nil
+}
+
+// parseAffinityRequirements recognizes the requirements built by affinityRequirements
+func parseAffinityRequirements(requirements string) (string, []int, bool) {
+	policy := ""
+	vmIds := []int{}
+
+	for _, condition := range strings.Split(requirements, " & ") {
+		var id int
+		if _, err := fmt.Sscanf(condition, "CURRENT_VMS != %d", &id); err == nil && policy != "affinity" {
+			policy = "anti-affinity"
+		} else if _, err := fmt.Sscanf(condition, "CURRENT_VMS = %d", &id); err == nil && policy != "anti-affinity" {
+			policy = "affinity"
+		} else {
+			return "", nil, false
+		}
+		vmIds = append(vmIds, id)
+	}
+
+	return policy, vmIds, requirements == affinityRequirements(policy, vmIds)
+}
+
+// vmClient returns the client for the endpoint the VM is pinned to, or the provider's
+func vmClient(endpoint string, meta interface{}) (*Client, error) {
+	return meta.(*Client).ForEndpoint(endpoint)
+}
+
+func resourceVmExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	err := resourceVmRead(d, meta)
+	// a terminated VM is in state 6 (DONE)
+	if err != nil || d.Id() == "" || d.Get("state").(int) == 6 {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceVmUpdate(d *schema.ResourceData, meta interface{}) error {
+	meta, err := vmClient(d.Get("endpoint").(string), meta)
+	if err != nil {
+		return err
+	}
+
+	client := meta.(*Client)
+
+	if d.HasChange("permissions") && d.Get("manage_permissions").(bool) {
+		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vm.chmod")
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated VM %s\n", resp)
+	}
+
+	if d.HasChange("size") || d.HasChange("disk") || d.HasChange("cpu") || d.HasChange("vcpu") || d.HasChange("memory") {
+		if err := resourceVmApplyResize(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("network_context") {
+		context := map[string]string{"ETH0_DNS": "", "ETH0_GATEWAY": "", "ETH0_MTU": ""}
+		if value, ok := d.GetOk("network_context"); ok {
+			for k, v := range nicContext(0, value.([]interface{})[0].(map[string]interface{})) {
+				context[k] = v
+			}
+		}
+		if err := updateVmContext(d, meta, context); err != nil {
+			return err
+		}
+		log.Printf("[INFO] VM %s will apply the new network context from its next boot on\n", d.Id())
+	}
+
+	// anything else of the nic blocks changing requires a new VM
+	if d.HasChange("nic") {
+		o, n := d.GetChange("nic")
+		context := map[string]string{}
+		for k := range nicBlocksContext(o.([]interface{})) {
+			context[k] = ""
+		}
+		for k, v := range nicBlocksContext(n.([]interface{})) {
+			context[k] = v
+		}
+		if err := updateVmContext(d, meta, context); err != nil {
+			return err
+		}
+		log.Printf("[INFO] VM %s will apply the new network context of its NICs from its next boot on\n", d.Id())
+	}
+
+	if d.HasChange("context_target") {
+		if err := updateVmContext(d, meta, map[string]string{"TARGET": d.Get("context_target").(string)}); err != nil {
+			return err
+		}
+		log.Printf("[INFO] VM %s will attach its context as %s from its next boot on\n", d.Id(), d.Get("context_target"))
+	}
+
+	if d.HasChange("context") || d.HasChange("ssh_public_key") || d.HasChange("start_script") {
+		context := map[string]string{}
+		old, new := d.GetChange("context")
+		for k := range old.(map[string]interface{}) {
+			context[k] = ""
+		}
+		for k, v := range new.(map[string]interface{}) {
+			context[k] = v.(string)
+		}
+		if d.HasChange("ssh_public_key") {
+			context["SSH_PUBLIC_KEY"] = d.Get("ssh_public_key").(string)
+		}
+		if d.HasChange("start_script") {
+			context["START_SCRIPT"] = ""
+			context["START_SCRIPT_BASE64"] = base64.StdEncoding.EncodeToString([]byte(d.Get("start_script").(string)))
+		}
+		if err := updateVmContext(d, meta, context); err != nil {
+			return err
+		}
+		log.Printf("[INFO] VM %s will apply the new context from its next boot on\n", d.Id())
+	}
+
+	contextChanged := d.HasChange("network_context") || d.HasChange("nic") || d.HasChange("context_target") || d.HasChange("context") ||
+		d.HasChange("ssh_public_key") || d.HasChange("start_script")
+	if contextChanged && d.Get("reboot_on_context_change").(bool) {
+		if err := rebootVm(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("security_group_ids") {
+		securityGroups := idListString(d.Get("security_group_ids").([]interface{}))
+		set, remove := map[string]string{"SECURITY_GROUPS": securityGroups}, []string{}
+		if securityGroups == "" {
+			set, remove = map[string]string{}, []string{"SECURITY_GROUPS"}
+		}
+		if err := updateVmUserTemplate(d, meta, set, remove); err != nil {
+			return err
+		}
+	}
+
+	// the NICs of nic blocks are only replaced along with the VM
+	nicArgsChanged := d.HasChange("network") || d.HasChange("network_uname") || d.HasChange("security_group_id") ||
+		d.HasChange("security_group_ids") || d.HasChange("network_raw") || d.HasChange("network_bandwidth")
+	if nicArgsChanged && len(d.Get("nic").([]interface{})) == 0 {
+		if err := resourceVmReattachNic(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("data_disk") {
+		old, new := d.GetChange("data_disk")
+		if err := resourceVmUpdateDataDisks(d, meta, old.([]interface{}), new.([]interface{})); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("floating_ip") {
+		old, new := d.GetChange("floating_ip")
+		if err := resourceVmUpdateFloatingIps(d, meta, old.([]interface{}), new.([]interface{})); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("name") {
+		resp, err := client.Call(
+			"one.vm.rename",
+			intId(d.Id()),
+			fmt.Sprintf("%s", d.Get("name").(string)),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated VM %s\n", resp)
+	}
+
+	if d.HasChange("metadata") {
+		old, new := d.GetChange("metadata")
+		set := map[string]string{}
+		for k, v := range new.(map[string]interface{}) {
+			set[k] = v.(string)
+		}
+		remove := []string{}
+		for k := range old.(map[string]interface{}) {
+			if _, ok := set[k]; !ok {
+				remove = append(remove, k)
+			}
+		}
+
+		if err := updateVmUserTemplate(d, meta, set, remove); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated metadata of VM %s\n", d.Id())
+	}
+
+	if d.HasChange("sched_action") {
+		if err := resourceVmUpdateSchedActions(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("sched_requirements") {
+		if err := resourceVmUpdateSchedRequirements(d, meta); err != nil {
+			return err
+		}
+	}
+
+	// only taken into account the next time the VM is deployed
+	if d.HasChange("sched_ds_requirements") {
+		requirements := d.Get("sched_ds_requirements").(string)
+		set, remove := map[string]string{"SCHED_DS_REQUIREMENTS": requirements}, []string{}
+		if requirements == "" {
+			set, remove = map[string]string{}, []string{"SCHED_DS_REQUIREMENTS"}
+		}
+		if err := updateVmUserTemplate(d, meta, set, remove); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated datastore requirements of VM %s\n", d.Id())
+		inherited := []string{}
+		for _, arg := range d.Get("template_inherited").([]interface{}) {
+			inherited = append(inherited, arg.(string))
+		}
+		d.Set("template_inherited", templateInherited(d, inherited))
+	}
+
+	// a VM being stopped is stopped before its OS is changed
+	stopFirst := d.HasChange("desired_state") && d.Get("desired_state").(string) != "running"
+	if stopFirst {
+		if err := changeVmPowerState(d, meta, d.Get("desired_state").(string)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("graphics") || d.HasChange("os") {
+		if err := resourceVmUpdateConf(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("desired_state") && !stopFirst {
+		if err := changeVmPowerState(d, meta, d.Get("desired_state").(string)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebootVm reboots a running VM, so the guest reads its context again
+func rebootVm(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	vm, _, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if vm.State != 3 || vm.LcmState != 3 {
+		log.Printf("[INFO] Not rebooting VM %s, it isn't running\n", d.Id())
+		return nil
+	}
+
+	if _, err = client.Call("one.vm.action", "reboot", intId(d.Id())); err != nil {
+		return err
+	}
+	if _, err = waitForVmState(d, meta, "running"); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine (%s) to reboot: %s", d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully rebooted VM %s\n", d.Id())
+	return nil
+}
+
+// resourceVmUpdateConf changes the graphics and OS of the VM in place. OpenNebula only updates
+// the configuration of a VM that's powered off or undeployed, which takes effect when it's
+// started again.
+func resourceVmUpdateConf(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	vm, _, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if vm.State != 8 && vm.State != 9 {
+		return fmt.Errorf("%q and %q of VM %s can only be changed while it's powered off or undeployed, e.g. with %q poweroff",
+			"graphics", "os", d.Id(), "desired_state")
+	}
+
+	changed := map[string]string{}
+	if value, ok := d.GetOk("graphics"); ok && d.HasChange("graphics") {
+		changed["GRAPHICS"] = graphicsVector(value.([]interface{})[0].(map[string]interface{}))
+	}
+	if value, ok := d.GetOk("os"); ok && d.HasChange("os") {
+		osAttrs, err := vmTemplateVector(vm, "OS")
+		if err != nil {
+			return err
+		}
+		changed["OS"] = osVector(osAttrs, value.([]interface{})[0].(map[string]interface{}))
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	template, err := vmUpdateconfTemplate(vm, changed)
+	if err != nil {
+		return err
+	}
+
+	if _, err = client.Call("one.vm.updateconf", intId(d.Id()), template); err != nil {
+		return fmt.Errorf("Error updating the configuration of VM %s: %s", d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully updated the configuration of VM %s\n", d.Id())
+	return nil
+}
+
+// graphicsVector renders the graphics block as a GRAPHICS vector
+func graphicsVector(graphics map[string]interface{}) string {
+	attrs := map[string]string{"TYPE": graphics["type"].(string)}
+	if graphics["listen"].(string) != "" {
+		attrs["LISTEN"] = graphics["listen"].(string)
+	}
+	if graphics["port"].(int) > 0 {
+		attrs["PORT"] = strconv.Itoa(graphics["port"].(int))
+	}
+	if graphics["keymap"].(string) != "" {
+		attrs["KEYMAP"] = graphics["keymap"].(string)
+	}
+	if graphics["tls_port"].(int) > 0 {
+		attrs["TLS_PORT"] = strconv.Itoa(graphics["tls_port"].(int))
+	}
+	if graphics["sound"].(bool) {
+		attrs["SOUND"] = "YES"
+	}
+	if graphics["usb_redirection"].(int) > 0 {
+		attrs["USB_REDIRECTION"] = strconv.Itoa(graphics["usb_redirection"].(int))
+	}
+	if graphics["passwd"].(string) != "" {
+		attrs["PASSWD"] = graphics["passwd"].(string)
+	}
+
+	return vectorString("GRAPHICS", attrs)
+}
+
+// osVector renders the os block as an OS vector, keeping the other OS attributes of base
+func osVector(base map[string]string, firmware map[string]interface{}) string {
+	base["FIRMWARE"] = firmware["firmware"].(string)
+	delete(base, "FIRMWARE_SECURE")
+	if firmware["firmware_secure"].(bool) {
+		base["FIRMWARE_SECURE"] = "YES"
+	}
+	if firmware["boot"].(string) != "" {
+		base["BOOT"] = firmware["boot"].(string)
+	}
+
+	return vectorString("OS", base)
+}
+
+// validateReservationLeases fails early if the VM is attached to a reservation without free leases
+func validateReservationLeases(d *schema.ResourceDiff, meta interface{}) error {
+	if !d.NewValueKnown("network") {
+		return nil
+	}
+	client := meta.(*Client)
+
+	// the vnet may be created in the same run, which is validated by OpenNebula
+	vnId, err := vnetIdByName(client, d.Get("network").(string))
+	if err != nil {
+		log.Printf("[DEBUG] Not validating the leases of vnet %s: %s", d.Get("network"), err)
+		return nil
+	}
+	vnet, err := client.vnetAddressRanges(vnId)
+	if err != nil {
+		return err
+	}
+
+	if vnet.ParentNetworkId != "" && vnet.FreeLeases() <= 0 {
+		return fmt.Errorf("Reservation %s has no free leases left", d.Get("network"))
+	}
+
+	return nil
+}
+
+// validatePlacementMode checks host_id matches the placement_mode. A host_id that isn't known
+// yet can't be told from an unset one, so manual placement is checked again on create.
+func validatePlacementMode(d *schema.ResourceDiff) error {
+	if !d.NewValueKnown("host_id") {
+		return nil
+	}
+	_, pinned := d.GetOkExists("host_id")
+
+	switch d.Get("placement_mode").(string) {
+	case "auto":
+		if pinned {
+			return fmt.Errorf("%q auto leaves placing the VM to the scheduler, it conflicts with %q", "placement_mode", "host_id")
+		}
+	case "manual":
+		if !pinned {
+			return fmt.Errorf("%q manual requires %q", "placement_mode", "host_id")
+		}
+	}
+
+	return nil
+}
+
+// validateDeployDatastore checks the VM can be deployed on the system datastore it's pinned to
+func validateDeployDatastore(d *schema.ResourceDiff, meta interface{}) error {
+	var ds struct {
+		Type       int   `xml:"TYPE"`
+		ClusterIds []int `xml:"CLUSTERS>ID"`
+	}
+	var host struct {
+		ClusterId int `xml:"CLUSTER_ID"`
+	}
+
+	if !d.NewValueKnown("deploy_datastore_id") || !d.NewValueKnown("host_id") {
+		return nil
+	}
+	dsId, ok := d.GetOkExists("deploy_datastore_id")
+	if !ok {
+		return nil
+	}
+	hostId, ok := d.GetOkExists("host_id")
+	if !ok {
+		return fmt.Errorf("%q requires %q, the scheduler picks the datastore otherwise", "deploy_datastore_id", "host_id")
+	}
+
+	client := meta.(*Client)
+	resp, err := client.Call("one.datastore.info", dsId.(int), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &ds); err != nil {
+		return err
+	}
+	// 1 is SYSTEM_DS
+	if ds.Type != 1 {
+		return fmt.Errorf("Datastore %d is not a system datastore", dsId)
+	}
+
+	resp, err = client.Call("one.host.info", hostId.(int), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &host); err != nil {
+		return err
+	}
+	for _, clusterId := range ds.ClusterIds {
+		if clusterId == host.ClusterId {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("System datastore %d is not available in cluster %d of host %d", dsId, host.ClusterId, hostId)
+}
+
+// deployVm deploys a held VM on the given host
+func deployVm(d *schema.ResourceData, client *Client, hostId int) error {
+	enforce := d.Get("enforce_deploy_capacity").(bool)
+
+	dsId := -1 // let OpenNebula pick the system datastore
+	if value, ok := d.GetOkExists("deploy_datastore_id"); ok {
+		dsId = value.(int)
+	}
+
+	_, err := client.Call("one.vm.deploy", intId(d.Id()), hostId, enforce, dsId)
+	if err != nil && enforce {
+		return fmt.Errorf(
+			"Error deploying VM %s on host %d, which may lack capacity for it (set enforce_deploy_capacity = false to overcommit the host): %s",
+			d.Id(), hostId, err)
+	} else if err != nil {
+		return fmt.Errorf("Error deploying VM %s on host %d: %s", d.Id(), hostId, err)
+	}
+
+	log.Printf("[INFO] Successfully deployed VM %s on host %d\n", d.Id(), hostId)
+	return nil
+}
+
+// checkDuplicateVmName reports VMs with the same name as the one to create. They could be taken
+// for the new VM when looking it up by name.
+func checkDuplicateVmName(d *schema.ResourceData, client *Client, name string) error {
+	var vms *UserVms
+
+	resp, err := client.Call("one.vmpool.info", -2, -1, -1)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vms); err != nil {
+		return err
+	}
+
+	for _, vm := range vms.UserVm {
+		if vm.Name != name {
+			continue
+		}
+		if !d.Get("allow_duplicate_name").(bool) {
+			return fmt.Errorf("VM %s of user %s is named %s already, set allow_duplicate_name to create another one", vm.Id, vm.Uname, name)
+		}
+		log.Printf("[WARNING] VM %s of user %s is named %s already", vm.Id, vm.Uname, name)
+	}
+
+	return nil
+}
+
+// vmByExternalId returns the VM tagged with the given external_id, or nil if there's none
+func vmByExternalId(client *Client, externalId string) (*UserVm, error) {
+	var vms *UserVms
+
+	resp, err := client.Call("one.vmpool.info", -2, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vms); err != nil {
+		return nil, err
+	}
+
+	for _, vm := range vms.UserVm {
+		if vm.VmUserTemplate != nil && vm.VmUserTemplate.ExternalId == externalId {
+			return vm, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Names of the LCM states, indexed by their number. 13 and 14 are no longer used.
+var vmLcmStates = []string{
+	"LCM_INIT", "PROLOG", "BOOT", "RUNNING", "MIGRATE", "SAVE_STOP", "SAVE_SUSPEND",
+	"SAVE_MIGRATE", "PROLOG_MIGRATE", "PROLOG_RESUME", "EPILOG_STOP", "EPILOG", "SHUTDOWN",
+	"", "", "CLEANUP_RESUBMIT", "UNKNOWN", "HOTPLUG", "SHUTDOWN_POWEROFF", "BOOT_UNKNOWN",
+	"BOOT_POWEROFF", "BOOT_SUSPENDED", "BOOT_STOPPED", "CLEANUP_DELETE", "HOTPLUG_SNAPSHOT",
+	"HOTPLUG_NIC", "HOTPLUG_SAVEAS", "HOTPLUG_SAVEAS_POWEROFF", "HOTPLUG_SAVEAS_SUSPENDED",
+	"SHUTDOWN_UNDEPLOY", "EPILOG_UNDEPLOY", "PROLOG_UNDEPLOY", "BOOT_UNDEPLOY",
+	"HOTPLUG_PROLOG_POWEROFF", "HOTPLUG_EPILOG_POWEROFF", "BOOT_MIGRATE", "BOOT_FAILURE",
+	"BOOT_MIGRATE_FAILURE", "PROLOG_MIGRATE_FAILURE", "PROLOG_FAILURE", "EPILOG_FAILURE",
+	"EPILOG_STOP_FAILURE", "EPILOG_UNDEPLOY_FAILURE", "PROLOG_MIGRATE_POWEROFF",
+	"PROLOG_MIGRATE_POWEROFF_FAILURE", "PROLOG_MIGRATE_SUSPEND", "PROLOG_MIGRATE_SUSPEND_FAILURE",
+	"BOOT_UNDEPLOY_FAILURE", "BOOT_STOPPED_FAILURE", "PROLOG_RESUME_FAILURE",
+	"PROLOG_UNDEPLOY_FAILURE", "DISK_SNAPSHOT_POWEROFF", "DISK_SNAPSHOT_REVERT_POWEROFF",
+	"DISK_SNAPSHOT_DELETE_POWEROFF", "DISK_SNAPSHOT_SUSPENDED", "DISK_SNAPSHOT_REVERT_SUSPENDED",
+	"DISK_SNAPSHOT_DELETE_SUSPENDED", "DISK_SNAPSHOT", "DISK_SNAPSHOT_REVERT", "DISK_SNAPSHOT_DELETE",
+	"PROLOG_MIGRATE_UNKNOWN", "PROLOG_MIGRATE_UNKNOWN_FAILURE", "DISK_RESIZE",
+	"DISK_RESIZE_POWEROFF", "DISK_RESIZE_UNDEPLOYED",
+}
+
+var vmStateNames = []string{
+	"INIT", "PENDING", "HOLD", "ACTIVE", "STOPPED", "SUSPENDED", "DONE", "",
+	"POWEROFF", "UNDEPLOYED", "CLONING", "CLONING_FAILURE",
+}
+
+// Entries kept in lifecycle_log, older ones are dropped
+const lifecycleLogMax = 50
+
+// recordLifecycle adds the current state of the VM to lifecycle_log, if it changed
+func recordLifecycle(d *schema.ResourceData, vm *UserVm) {
+	state := ""
+	if vm.State == 3 && vm.LcmState < len(vmLcmStates) {
+		state = vmLcmStates[vm.LcmState]
+	} else if vm.State != 3 && vm.State < len(vmStateNames) {
+		state = vmStateNames[vm.State]
+	}
+	if state == "" {
+		state = fmt.Sprintf("%d/%d", vm.State, vm.LcmState)
+	}
+
+	entries := d.Get("lifecycle_log").([]interface{})
+	if len(entries) > 0 && entries[len(entries)-1].(map[string]interface{})["state"] == state {
+		return
+	}
+
+	entries = append(entries, map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339),
+		"state": state,
+	})
+	if len(entries) > lifecycleLogMax {
+		entries = entries[len(entries)-lifecycleLogMax:]
+	}
+	d.Set("lifecycle_log", entries)
+}
+
+// vmLcmState returns the number of the named LCM state, or -1 if there's no such state
+func vmLcmState(name string) int {
+	for i, lcmState := range vmLcmStates {
+		if lcmState != "" && lcmState == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// LCM states a VM goes through before it's RUNNING for the first time
+var vmDeployLcmStates = map[string]bool{"LCM_INIT": true, "PROLOG": true, "BOOT": true}
+
+// Actions bringing a VM into each power state, and the VM states they map to
+var vmPowerActions = map[string]string{
+	"running":    "resume",
+	"poweroff":   "poweroff",
+	"undeployed": "undeploy",
+}
+
+var vmPowerStates = map[int]string{
+	3: "running",
+	8: "poweroff",
+	9: "undeployed",
+}
+
+func changeVmPowerState(d *schema.ResourceData, meta interface{}, state string) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.vm.action", vmPowerActions[state], intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	if _, err = waitForVmState(d, meta, state); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine (%s) to be in state %s: %s", d.Id(), state, err)
+	}
+
+	log.Printf("[INFO] Successfully changed power state of VM %s to %s\n", resp, state)
+	return nil
+}
+
+// validateUserInputs checks the user inputs cover all mandatory USER_INPUTS of the VM template,
+// and nothing it doesn't ask for
+func validateUserInputs(d *schema.ResourceDiff, meta interface{}) error {
+	var tmpl struct {
+		UserInputs *Vector `xml:"TEMPLATE>USER_INPUTS"`
+	}
+	client := meta.(*Client)
+	templateId := d.Get("template_id").(int)
+
+	resp, err := client.Call("one.template.info", templateId, false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &tmpl); err != nil {
+		return err
+	}
+
+	declared := map[string]string{}
+	if tmpl.UserInputs != nil {
+		declared = tmpl.UserInputs.Map()
+	}
+	values := d.Get("user_inputs").(map[string]interface{})
+
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			return fmt.Errorf("VM template %d has no user input %s", templateId, name)
+		}
+	}
+	// inputs look like "M|text|Description| |default", M being mandatory and O optional
+	missing := []string{}
+	for name, input := range declared {
+		fields := strings.Split(input, "|")
+		mandatory := fields[0] == "M" && (len(fields) < 5 || fields[4] == "")
+		if _, ok := values[name]; mandatory && !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("VM template %d requires the user inputs %s", templateId, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// clonePersistentTemplate copies the VM template along with its images, made persistent so they
+// keep the data of the VM. OpenNebula names the images after the copy.
+func clonePersistentTemplate(d *schema.ResourceData, client *Client) (int, []int, error) {
+	var tmpl struct {
+		ImageIds []int `xml:"TEMPLATE>DISK>IMAGE_ID"`
+	}
+
+	name := d.Get("clone_name").(string)
+	if name == "" {
+		name = d.Get("name").(string)
+	}
+	if name == "" {
+		return 0, nil, fmt.Errorf("%q requires %q or %q", "persistent_clone", "name", "clone_name")
+	}
+
+	resp, err := client.Call("one.template.clone", d.Get("template_id"), name, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	cloneId := intId(resp)
+	d.Set("cloned_template_id", cloneId)
+
+	resp, err = client.Call("one.template.info", cloneId, false)
+	if err == nil {
+		err = xml.Unmarshal([]byte(resp), &tmpl)
+	}
+	if err != nil {
+		deleteClonedTemplate(client, cloneId)
+		return 0, nil, err
+	}
+	d.Set("cloned_image_ids", tmpl.ImageIds)
+
+	for _, imageId := range tmpl.ImageIds {
+		if _, err = client.Call("one.image.persistent", imageId, true); err != nil {
+			deleteClonedTemplate(client, cloneId)
+			return 0, nil, fmt.Errorf("Error making image %d of template %s persistent: %s", imageId, name, err)
+		}
+	}
+
+	log.Printf("[INFO] Successfully cloned template %d as %s (%d) with images %v\n", d.Get("template_id"), name, cloneId, tmpl.ImageIds)
+	return cloneId, tmpl.ImageIds, nil
+}
+
+// deleteClonedTemplate deletes the copy of persistent_clone along with its images, once no VM uses them
+func deleteClonedTemplate(client *Client, cloneId int) {
+	if _, err := client.Call("one.template.delete", cloneId, true); err != nil {
+		log.Printf("[WARNING] Could not delete template %d cloned for the VM, nor its images: %s", cloneId, err)
+		return
+	}
+	log.Printf("[INFO] Successfully deleted cloned template %d and its images\n", cloneId)
+}
+
+// templateVector returns a vector attribute of a VM template, e.g. its CONTEXT. A vector in the
+// instantiate template replaces the one of the VM template, so attributes are added to this one instead.
+func templateVector(client *Client, templateId int, name string) (map[string]string, error) {
+	var tmpl struct {
+		Template *Vector `xml:"TEMPLATE"`
+	}
+
+	resp, err := client.Call("one.template.info", templateId, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &tmpl); err != nil {
+		return nil, err
+	}
+
+	return subVector(tmpl.Template, name), nil
+}
+
+// vmTemplateVector returns the attributes of a vector of the VM template, e.g. OS
+func vmTemplateVector(vm *UserVm, name string) (map[string]string, error) {
+	template := &Vector{}
+	if err := xml.Unmarshal([]byte("<TEMPLATE>"+vm.VmTemplate.Raw+"</TEMPLATE>"), template); err != nil {
+		return nil, err
+	}
+
+	return subVector(template, name), nil
+}
+
+// subVector returns the attributes of the first vector with the given name in a template
+func subVector(template *Vector, name string) map[string]string {
+	if template != nil {
+		for _, p := range template.Pairs {
+			if p.XMLName.Local == name {
+				return (&Vector{Pairs: p.Pairs}).Map()
+			}
+		}
+	}
+
+	return map[string]string{}
+}
+
+// hostnameForIp looks up the reverse DNS name of the IP, falling back to the given name, which
+// may be empty as well
+func hostnameForIp(ip, fallback string) string {
+	names, err := net.LookupAddr(ip)
+	if err != nil || len(names) == 0 {
+		log.Printf("[WARNING] No PTR record found for %s, using hostname %s: %v", ip, fallback, err)
+		return fallback
+	}
+
+	return strings.TrimSuffix(names[0], ".")
+}
+
+func resourceVmSetHostnameFromDns(d *schema.ResourceData, meta interface{}) error {
+	var vm *UserVm
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.vm.info", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
+	}
+
+	if vm.VmTemplate.Context == nil || vm.VmTemplate.Context.IP == "" {
+		log.Printf("[WARNING] VM %s has no IP to look up its hostname for", d.Id())
+		return nil
+	}
+
+	hostname := hostnameForIp(vm.VmTemplate.Context.IP, vm.Name)
+	if hostname == "" {
+		log.Printf("[WARNING] VM %s has neither a PTR record nor a name to use as hostname", d.Id())
+		return nil
+	}
+	if err = updateVmContext(d, meta, map[string]string{"SET_HOSTNAME": hostname}); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] VM %s will use hostname %s from its next boot on\n", d.Id(), hostname)
+	return nil
+}
+
+// waitForGuestAgent waits for the monitoring of the VM to include what only the guest agent reports.
+// With orReady, the guest setting READY=YES through OneGate will do as well.
+func waitForGuestAgent(d *schema.ResourceData, meta interface{}, orReady bool) error {
+	var vm *UserVm
+	client := meta.(*Client)
+	timeout, _ := time.ParseDuration(d.Get("guest_agent_timeout").(string))
+
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"waiting"},
+		Target:  []string{"connected"},
+		Refresh: func() (interface{}, string, error) {
+			resp, err := client.Call("one.vm.info", intId(d.Id()))
+			if err != nil {
+				return nil, "", err
+			}
+			if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+				return nil, "", err
+			}
+
+			if vm.Monitoring != nil {
+				monitoring := vm.Monitoring.Map()
+				if monitoring["GUEST_IP"] != "" || monitoring["GUEST_IP_ADDRESSES"] != "" {
+					return vm, "connected", nil
+				}
+			}
+			if orReady && vm.VmUserTemplate != nil && vm.VmUserTemplate.Vector.Map()["READY"] == "YES" {
+				return vm, "connected", nil
+			}
+			return vm, "waiting", nil
+		},
+		Timeout:    timeout,
+		MinTimeout: client.PollInterval,
+	}
+
+	if _, err := stateConf.WaitForState(); err != nil {
+		return fmt.Errorf("Error waiting for the guest agent of virtual machine (%s): %s", d.Id(), err)
+	}
+
+	log.Printf("[INFO] Guest agent of VM %s is connected\n", d.Id())
+	return nil
+}
+
+// resourceVmDetachContext detaches the context CDROM of a running VM, once the guest signalled it
+// booted through its guest agent or READY=YES. The context is gone for good afterwards.
+// one.vm.detach only detaches DISKs, so the CONTEXT is dropped with updateconf instead, which
+// OpenNebula only applies to a VM that's powered off.
+func resourceVmDetachContext(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if err := waitForGuestAgent(d, meta, true); err != nil {
+		return err
+	}
+	if err := changeVmPowerState(d, meta, "poweroff"); err != nil {
+		return err
+	}
+
+	// the VM is resumed either way, a failed detach doesn't leave it powered off
+	detachErr := dropVmContext(client, intId(d.Id()))
+	if err := changeVmPowerState(d, meta, "running"); err != nil {
+		return err
+	}
+	if detachErr != nil {
+		return detachErr
+	}
+
+	log.Printf("[INFO] Successfully detached the context of VM %s\n", d.Id())
+	return nil
+}
+
+// dropVmContext drops the CONTEXT of a VM that's powered off, and makes sure oned did. It keeps a
+// CONTEXT it doesn't accept to drop rather than failing.
+func dropVmContext(client *Client, id int) error {
+	var vm *UserVm
+
+	resp, err := client.Call("one.vm.info", id)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
+	}
+	template, err := vmUpdateconfTemplate(vm, map[string]string{"CONTEXT": ""})
+	if err != nil {
+		return err
+	}
+	if _, err = client.Call("one.vm.updateconf", id, template); err != nil {
+		return fmt.Errorf("Error detaching the context of VM %d: %s", id, err)
+	}
+
+	vm = nil
+	resp, err = client.Call("one.vm.info", id)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
+	}
+	if vm.VmTemplate != nil && vm.VmTemplate.Context != nil {
+		return fmt.Errorf("OpenNebula kept the context of VM %d, it can't be detached", id)
+	}
+
+	return nil
+}
+
+// Template attributes of the showback costs
+var vmCostAttrs = map[string]string{
+	"cpu_cost":    "CPU_COST",
+	"memory_cost": "MEMORY_COST",
+	"disk_cost":   "DISK_COST",
+}
+
+// readVmCosts reads the costs of the VM from its template, the only ones showback takes into account.
+// Costs merged into the user template by earlier versions are ignored.
+func readVmCosts(d *schema.ResourceData, vm *UserVm) error {
+	costs := map[string]string{
+		"CPU_COST":    vm.VmTemplate.CpuCost,
+		"MEMORY_COST": vm.VmTemplate.MemoryCost,
+		"DISK_COST":   vm.VmTemplate.DiskCost,
+	}
+
+	for k, attr := range vmCostAttrs {
+		cost := 0.0
+		if costs[attr] != "" {
+			var err error
+			if cost, err = strconv.ParseFloat(costs[attr], 64); err != nil {
+				return fmt.Errorf("Invalid %s of VM %s: %s", attr, d.Id(), err)
+			}
+		}
+		d.Set(k, cost)
+	}
+
+	return nil
+}
+
+// updateVmUserTemplate sets and removes attributes of the user template of the VM, keeping all others.
+// Removing attributes requires replacing the whole user template, since merging can't remove any.
+func updateVmUserTemplate(d *schema.ResourceData, meta interface{}, set map[string]string, remove []string) error {
+	var vm *UserVm
+	client := meta.(*Client)
+
+	if len(remove) == 0 {
+		attrs := &Vector{}
+		for k, v := range set {
+			attrs.Set(k, v)
+		}
+
+		_, err := client.Call(
+			"one.vm.update",
+			intId(d.Id()),
+			attrs.String(),
+			1, // merge with the existing user template
+		)
+		return err
+	}
+
+	resp, err := client.Call("one.vm.info", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
+	}
+
+	userTemplate := &Vector{}
+	if vm.VmUserTemplate != nil {
+		userTemplate = vm.VmUserTemplate.Vector
+	}
+	for _, k := range remove {
+		userTemplate.Remove(k)
+	}
+	for k, v := range set {
+		userTemplate.Set(k, v)
+	}
+
+	_, err = client.Call(
+		"one.vm.update",
+		intId(d.Id()),
+		userTemplate.String(),
+		0, // replace the whole user template instead of merging it with the existing one
+	)
+	return err
+}
+
+// updateVmContext sets the given attributes in the context of the VM, keeping all others.
+// Attributes set to an empty value are removed.
+// The guest only picks them up the next time it reads its context, i.e. on reboot.
+func updateVmContext(d *schema.ResourceData, meta interface{}, attrs map[string]string) error {
+	var vm *UserVm
 	client := meta.(*Client)
 
-	// build NIC template
-	nicArray = append(nicArray, fmt.Sprintf("NETWORK=\"%s\"", d.Get("network")))
-	if value, ok := d.GetOk("network_uname"); ok {
-		nicArray = append(nicArray, fmt.Sprintf("NETWORK_UNAME=\"%s\"", value))
+	resp, err := client.Call("one.vm.info", intId(d.Id()))
+	if err != nil {
+		return err
 	}
-	if value, ok := d.GetOk("search_domain"); ok {
-		nicArray = append(nicArray, fmt.Sprintf("SEARCH_DOMAIN=\"%s\"", value))
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
+	}
+
+	context := map[string]string{}
+	if vm.VmTemplate.Context != nil {
+		context = vm.VmTemplate.Context.Attributes
 	}
-	if value, ok := d.GetOk("security_group"); ok {
-		nicArray = append(nicArray, fmt.Sprintf("SECURITY_GROUP=\"%d\"", value))
+	for k, v := range attrs {
+		if v == "" {
+			delete(context, k)
+		} else {
+			context[k] = v
+		}
 	}
-	if value, ok := d.GetOk("ip"); ok {
-		nicArray = append(nicArray, fmt.Sprintf("IP=\"%s\"", value))
+
+	// updateconf replaces all of its sections, so the others are sent unchanged along with the context
+	template, err := vmUpdateconfTemplate(vm, map[string]string{"CONTEXT": vectorString("CONTEXT", context)})
+	if err != nil {
+		return err
 	}
+	_, err = client.Call("one.vm.updateconf", intId(d.Id()), template)
+	return err
+}
 
-	template += "NIC = [\n " + fmt.Sprintf(strings.Join(nicArray, ",\n ")) + " ]\n"
+// resourceVmUpdateSchedRequirements changes the host requirements of the VM. Unless it's
+// rescheduled, they're only taken into account the next time the VM is deployed.
+func resourceVmUpdateSchedRequirements(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
 
-	// build the disk part of the template
-	diskArray = append(diskArray, fmt.Sprintf("SIZE=\"%d\"", d.Get("size")))
-	if value, ok := d.GetOk("image"); ok {
-		diskArray = append(diskArray, fmt.Sprintf("IMAGE=\"%s\"", value))
+	requirements := d.Get("sched_requirements").(string)
+	set, remove := map[string]string{"SCHED_REQUIREMENTS": requirements}, []string{}
+	if requirements == "" {
+		set, remove = map[string]string{}, []string{"SCHED_REQUIREMENTS"}
 	}
-	if value, ok := d.GetOk("image_uname"); ok {
-		diskArray = append(diskArray, fmt.Sprintf("IMAGE_UNAME=\"%s\"", value))
+	if err := updateVmUserTemplate(d, meta, set, remove); err != nil {
+		return err
 	}
-	if value, ok := d.GetOk("image_driver"); ok {
-		diskArray = append(diskArray, fmt.Sprintf("IMAGE_DRIVER=\"%s\"", value))
+	log.Printf("[INFO] Successfully updated scheduling requirements of VM %s\n", d.Id())
+
+	if !d.Get("reschedule_on_requirement_change").(bool) {
+		return nil
 	}
 
-	template += "DISK = [\n " + fmt.Sprintf(strings.Join(diskArray, ",\n ")) + " ]\n"
+	// the scheduler migrates the VM on its next run, leaving a SCHED_MESSAGE if it can't
+	if _, err := client.Call("one.vm.action", "resched", intId(d.Id())); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Successfully rescheduled VM %s\n", d.Id())
+	return nil
+}
 
-	// add cpus if requested
-	if value, ok := d.GetOk("cpu"); ok {
-		template += fmt.Sprintf("CPU = \"%d\"\n", value)
+// Bandwidth limits of a NIC, in KB/s, and the NIC attributes they're stored in
+var nicBandwidthAttrs = map[string]string{
+	"inbound_avg_bw":   "INBOUND_AVG_BW",
+	"inbound_peak_bw":  "INBOUND_PEAK_BW",
+	"inbound_peak_kb":  "INBOUND_PEAK_KB",
+	"outbound_avg_bw":  "OUTBOUND_AVG_BW",
+	"outbound_peak_bw": "OUTBOUND_PEAK_BW",
+	"outbound_peak_kb": "OUTBOUND_PEAK_KB",
+}
+
+func nicBandwidthSchema() map[string]*schema.Schema {
+	descriptions := map[string]string{
+		"inbound_avg_bw":   "Average inbound bandwidth, in KB/s",
+		"inbound_peak_bw":  "Maximum inbound bandwidth during bursts, in KB/s",
+		"inbound_peak_kb":  "Data that can be received at peak bandwidth, in KB",
+		"outbound_avg_bw":  "Average outbound bandwidth, in KB/s",
+		"outbound_peak_bw": "Maximum outbound bandwidth during bursts, in KB/s",
+		"outbound_peak_kb": "Data that can be sent at peak bandwidth, in KB",
 	}
 
-	// add vcpu if requested
-	if value, ok := d.GetOk("vcpu"); ok {
-		template += fmt.Sprintf("VCPU = \"%d\"\n", value)
+	bandwidthSchema := map[string]*schema.Schema{}
+	for k := range nicBandwidthAttrs {
+		bandwidthSchema[k] = &schema.Schema{
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Description: descriptions[k],
+		}
 	}
 
-	// add memory if requested
-	if value, ok := d.GetOk("memory"); ok {
-		template += fmt.Sprintf("MEMORY = \"%d\"\n", value)
+	return bandwidthSchema
+}
+
+// nicBandwidth returns the NIC attributes for the configured bandwidth limits
+func nicBandwidth(d *schema.ResourceData) []string {
+	attrs := []string{}
+	if value, ok := d.GetOk("network_bandwidth"); ok {
+		for attr, limit := range nicBandwidthVector(value.([]interface{})[0].(map[string]interface{})) {
+			attrs = append(attrs, fmt.Sprintf("%s=\"%s\"", attr, limit))
+		}
 	}
+	sort.Strings(attrs)
 
-	resp, err := client.Call(
-		"one.template.instantiate",
-		d.Get("template_id"),
-		d.Get("name"),
-		false,
-		//todo: maybe use backticks
-		template,
-		false,
-	)
-	if err != nil {
-		return err
+	return attrs
+}
+
+// nicBandwidthVector returns the NIC attributes of the limits set in a bandwidth block
+func nicBandwidthVector(bandwidth map[string]interface{}) map[string]string {
+	attrs := map[string]string{}
+	for k, attr := range nicBandwidthAttrs {
+		if limit := bandwidth[k].(int); limit > 0 {
+			attrs[attr] = strconv.Itoa(limit)
+		}
 	}
 
-	d.SetId(resp)
+	return attrs
+}
 
-	_, err = waitForVmState(d, meta, "running")
-	if err != nil {
-		return fmt.Errorf(
-			"Error waiting for virtual machine (%s) to be in state RUNNING: %s", d.Id(), err)
+func readNicBandwidth(nic *Nic) []map[string]interface{} {
+	bandwidth := map[string]interface{}{
+		"inbound_avg_bw":   nic.InboundAvgBw,
+		"inbound_peak_bw":  nic.InboundPeakBw,
+		"inbound_peak_kb":  nic.InboundPeakKb,
+		"outbound_avg_bw":  nic.OutboundAvgBw,
+		"outbound_peak_bw": nic.OutboundPeakBw,
+		"outbound_peak_kb": nic.OutboundPeakKb,
 	}
+	for _, limit := range bandwidth {
+		if limit.(int) > 0 {
+			return []map[string]interface{}{bandwidth}
+		}
+	}
+
+	return []map[string]interface{}{}
+}
 
-	if _, ok := d.GetOk("permissions"); !ok {
-		d.Set("permissions", "640")
+func nicContextSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"dns": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			Description: "DNS servers (space separated)",
+		},
+		"gateway": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			Description: "Default gateway",
+		},
+		"mtu": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Computed:    true,
+			Description: "MTU of the interface",
+		},
 	}
+}
 
-	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vm.chmod"); err != nil {
-		return err
+// nicContext returns the context attributes configuring the NIC with the given index in the guest
+func nicContext(index int, nicCtx map[string]interface{}) map[string]string {
+	context := map[string]string{}
+	if value := nicCtx["dns"].(string); value != "" {
+		context[fmt.Sprintf("ETH%d_DNS", index)] = value
+	}
+	if value := nicCtx["gateway"].(string); value != "" {
+		context[fmt.Sprintf("ETH%d_GATEWAY", index)] = value
+	}
+	if value := nicCtx["mtu"].(int); value > 0 {
+		context[fmt.Sprintf("ETH%d_MTU", index)] = strconv.Itoa(value)
 	}
 
-	return resourceVmRead(d, meta)
+	return context
 }
 
-func resourceVmRead(d *schema.ResourceData, meta interface{}) error {
-	var vm *UserVm
-	var vms *UserVms
+// readNicContext is the reverse of nicContext
+func readNicContext(index int, context map[string]string) map[string]interface{} {
+	mtu, _ := strconv.Atoi(context[fmt.Sprintf("ETH%d_MTU", index)])
 
-	client := meta.(*Client)
-	found := false
-	name := d.Get("name").(string)
-	if name == "" {
-		name = d.Get("instance").(string)
+	return map[string]interface{}{
+		"dns":     context[fmt.Sprintf("ETH%d_DNS", index)],
+		"gateway": context[fmt.Sprintf("ETH%d_GATEWAY", index)],
+		"mtu":     mtu,
 	}
+}
 
-	// Try to find the vm by ID, if specified
-	if d.Id() != "" {
-		resp, err := client.Call("one.vm.info", intId(d.Id()))
-		if err == nil {
-			found = true
-			if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
-				return err
-			}
-		} else {
-			log.Printf("Could not find VM by ID %s", d.Id())
+// readGuestNetwork returns the addressing of every NIC in the context, ordered by index. Indexes
+// may have gaps, e.g. after a NIC was detached.
+func readGuestNetwork(context map[string]string) []map[string]interface{} {
+	indexes := []int{}
+	for k := range context {
+		if !strings.HasPrefix(k, "ETH") || !strings.HasSuffix(k, "_MAC") {
+			continue
+		}
+		if index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(k, "ETH"), "_MAC")); err == nil {
+			indexes = append(indexes, index)
 		}
 	}
+	sort.Ints(indexes)
 
-	// Otherwise, try to find the vm by (user, name) as the de facto compound primary key
-	if d.Id() == "" || !found {
-		resp, err := client.Call("one.vmpool.info", -3, -1, -1)
-		if err != nil {
+	nics := []map[string]interface{}{}
+	for _, index := range indexes {
+		attr := func(name string) string { return context[fmt.Sprintf("ETH%d_%s", index, name)] }
+		nics = append(nics, map[string]interface{}{
+			"index":   index,
+			"mac":     attr("MAC"),
+			"ip":      attr("IP"),
+			"mask":    attr("MASK"),
+			"gateway": attr("GATEWAY"),
+			"dns":     attr("DNS"),
+			"ip6":     attr("IP6"),
+		})
+	}
+
+	return nics
+}
+
+// Power states a resize_strategy stops the VM in
+var vmResizeStopStates = map[string]string{
+	"poweroff": "poweroff",
+	"cold":     "undeployed",
+}
+
+// resourceVmApplyResize resizes the disk, CPU and memory of the VM. A running VM is stopped first
+// if the resize_strategy asks for it, and started again once all resizes are done.
+func resourceVmApplyResize(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	vm, _, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	// VCPUs are hotplugged without stopping the VM, unless other changes need it stopped
+	hotAdd := d.Get("hot_add_cpu").(bool) && !d.HasChange("cpu") && !d.HasChange("size") && !d.HasChange("disk") &&
+		(!d.HasChange("memory") || d.Get("memory_max").(int) > 0)
+
+	stopState, stop := vmResizeStopStates[d.Get("resize_strategy").(string)]
+	restart := stop && vm.State == 3 && !hotAdd
+	if restart {
+		if err = changeVmPowerState(d, meta, stopState); err != nil {
 			return err
 		}
+	}
 
-		if err = xml.Unmarshal([]byte(resp), &vms); err != nil {
+	if d.HasChange("size") || d.HasChange("disk") {
+		if err = resourceVmResizeDisks(d, meta); err != nil {
 			return err
 		}
+	}
 
-		for _, v := range vms.UserVm {
-			if v.Name == name {
-				vm = v
-				found = true
-				break
-			}
+	if d.HasChange("cpu") || d.HasChange("vcpu") || d.HasChange("memory") {
+		if err = resourceVmResize(d, meta); err != nil {
+			return err
 		}
+	}
 
-		if !found || vm == nil {
-			d.SetId("")
-			log.Printf("Could not find vm with name %s for user %s", name, client.Username)
-			return nil
+	if restart {
+		return changeVmPowerState(d, meta, "running")
+	}
+
+	return nil
+}
+
+// resourceVmResizeDisks resizes the single disk of size, or each disk block whose size changed.
+// The filesystems of a disk block's grow_fs are grown by the guest on its next boot.
+func resourceVmResizeDisks(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	o, n := d.GetChange("disk")
+	sizes, growFs := diskResizes(o.([]interface{}), n.([]interface{}))
+	if d.HasChange("size") && len(d.Get("disk").([]interface{})) == 0 {
+		sizes[0] = d.Get("size").(int)
+	}
+
+	for diskId, size := range sizes {
+		if _, err := client.Call("one.vm.diskresize", intId(d.Id()), diskId, strconv.Itoa(size)); err != nil {
+			return fmt.Errorf("Error resizing disk %d of VM %s: %s", diskId, d.Id(), err)
 		}
+		log.Printf("[INFO] Successfully resized disk %d of VM %s\n", diskId, d.Id())
 	}
 
-	d.SetId(vm.Id)
-	d.Set("instance", vm.Name)
-	d.Set("uid", vm.Uid)
-	d.Set("gid", vm.Gid)
-	d.Set("uname", vm.Uname)
-	d.Set("gname", vm.Gname)
-	d.Set("state", vm.State)
-	d.Set("lcmstate", vm.LcmState)
-	d.Set("cpu", vm.VmTemplate.Cpu)
-	d.Set("vcpu", vm.VmTemplate.Vcpu)
-	d.Set("memory", vm.VmTemplate.Memory)
-	d.Set("image", vm.VmTemplate.Disk.Image)
-	d.Set("size", vm.VmTemplate.Disk.Size)
-	d.Set("image_driver", vm.VmTemplate.Disk.ImageDriver)
-	d.Set("image_uname", vm.VmTemplate.Disk.ImageUname)
-	d.Set("network_uname", vm.VmTemplate.Nic.NetworkUname)
-	d.Set("network_search_domain", vm.VmTemplate.Nic.NetworkSearchDomain)
-	d.Set("security_group_id", vm.VmTemplate.Nic.SecurityGroupId)
-	d.Set("network", vm.VmTemplate.Nic.Network)
-	d.Set("ip", vm.VmTemplate.Context.IP)
-	d.Set("permissions", permissionString(vm.Permissions))
+	// the guest can only grow its filesystems when it reads its context on the next boot
+	if len(growFs) > 0 {
+		if err := updateVmContext(d, meta, map[string]string{"GROW_FS": strings.Join(growFs, " ")}); err != nil {
+			return err
+		}
+		log.Printf("[INFO] VM %s will grow %s on its next boot\n", d.Id(), strings.Join(growFs, " "))
+	}
 
 	return nil
 }
 
-func resourceVmExists(d *schema.ResourceData, meta interface{}) (bool, error) {
-	err := resourceVmRead(d, meta)
-	// a terminated VM is in state 6 (DONE)
-	if err != nil || d.Id() == "" || d.Get("state").(int) == 6 {
-		return false, err
+// resourceVmResize changes the CPU, VCPU count and memory of the VM. The CustomizeDiff only lets
+// this happen in place within the limits declared when the VM was created, or on a stopped VM.
+func resourceVmResize(d *schema.ResourceData, meta interface{}) error {
+	var vm *UserVm
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.vm.info", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
 	}
 
-	return true, nil
+	state := "running"
+	if vm.State == 8 {
+		state = "poweroff"
+	} else if vm.State == 9 {
+		state = "undeployed"
+	}
+
+	template := fmt.Sprintf("VCPU = \"%d\"\nMEMORY = \"%d\"\n", d.Get("vcpu"), d.Get("memory"))
+	if d.HasChange("cpu") {
+		template += fmt.Sprintf("CPU = \"%v\"\n", d.Get("cpu"))
+	}
+	if _, err = client.Call("one.vm.resize", intId(d.Id()), template, false); err != nil {
+		return err
+	}
+
+	if _, err = waitForVmState(d, meta, state); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine (%s) to be resized: %s", d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully resized VM %s to %d VCPU and %d MB\n", d.Id(), d.Get("vcpu"), d.Get("memory"))
+	return nil
 }
 
-func resourceVmUpdate(d *schema.ResourceData, meta interface{}) error {
+// resourceVmReattachNic replaces the NIC of the VM, since OpenNebula can't change the
+// network of a live NIC. The current IP is requested again on the new NIC, if it's still free.
+// On a new network, the IP is only requested if preserve_ip is set or ip was changed, and then
+// it has to be leased.
+func resourceVmReattachNic(d *schema.ResourceData, meta interface{}) error {
+	var vm *UserVm
 	client := meta.(*Client)
 
-	if d.HasChange("permissions") {
-		resp, err := changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vm.chmod")
-		if err != nil {
+	resp, err := client.Call("one.vm.info", intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return err
+	}
+
+	// the VM returns to the state it was in once the hotplug operation finished
+	state := "running"
+	if vm.State == 8 {
+		state = "poweroff"
+	}
+
+	// a VM left without a NIC, e.g. by a failed reattach, only gets the new one
+	prev := vm.VmTemplate.Nic()
+	if prev != nil {
+		if _, err = client.Call("one.vm.detachnic", intId(d.Id()), prev.NicId); err != nil {
 			return err
 		}
-		log.Printf("[INFO] Successfully updated VM %s\n", resp)
+
+		if _, err = waitForVmState(d, meta, state); err != nil {
+			return fmt.Errorf("Error waiting for virtual machine (%s) to detach its NIC: %s", d.Id(), err)
+		}
 	}
 
-	if d.HasChange("size") {
-		resp, err := client.Call(
-			"one.vm.diskresize",
-			intId(d.Id()),
-			0,
-			fmt.Sprintf("%d", d.Get("size").(int)),
-		)
-		if err != nil {
-			return err
+	nicArray := networkNicArray(d)
+	nic := "NIC = [\n " + strings.Join(nicArray, ",\n ") + " ]\n"
+	ip, strict := d.Get("ip").(string), false
+	if d.HasChange("network") {
+		strict = d.Get("preserve_ip").(bool) || d.HasChange("ip")
+		if !strict {
+			ip = ""
+		}
+	}
+	if ip != "" {
+		nicWithIp := "NIC = [\n " + strings.Join(append(nicArray, fmt.Sprintf("IP=\"%s\"", ip)), ",\n ") + " ]\n"
+		if _, err = client.Call("one.vm.attachnic", intId(d.Id()), nicWithIp); err == nil {
+			nic = ""
+		} else if strict {
+			err = fmt.Errorf("Error attaching virtual machine (%s) to network %s with IP %s: %s", d.Id(), d.Get("network"), ip, err)
+			if prev == nil {
+				return err
+			}
+			return restorePreviousNic(d, meta, prev, state, err)
+		} else {
+			log.Printf("[WARNING] Could not keep IP %s for VM %s, requesting a new one: %s", ip, d.Id(), err)
 		}
-		log.Printf("[INFO] Successfully updated VM %s\n", resp)
 	}
 
-	if d.HasChange("name") {
-		resp, err := client.Call(
-			"one.vm.rename",
-			intId(d.Id()),
-			fmt.Sprintf("%s", d.Get("name").(string)),
-		)
-		if err != nil {
+	if nic != "" {
+		if _, err = client.Call("one.vm.attachnic", intId(d.Id()), nic); err != nil {
 			return err
 		}
-		log.Printf("[INFO] Successfully updated VM %s\n", resp)
 	}
 
+	if _, err = waitForVmState(d, meta, state); err != nil {
+		return fmt.Errorf("Error waiting for virtual machine (%s) to attach its NIC: %s", d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully reattached NIC of VM %s\n", d.Id())
 	return nil
 }
 
+// restorePreviousNic attaches the NIC the VM had before a failed reattach again, with its lease,
+// rather than leaving the VM without a NIC. The failed attach is returned either way.
+func restorePreviousNic(d *schema.ResourceData, meta interface{}, prev *Nic, state string, attachErr error) error {
+	client := meta.(*Client)
+
+	nic := vectorString("NIC", map[string]string{
+		"NETWORK_ID": strconv.Itoa(prev.NetworkId),
+		"IP":         prev.Ip,
+		"MAC":        prev.Mac,
+	})
+	if _, err := client.Call("one.vm.attachnic", intId(d.Id()), nic); err != nil {
+		return fmt.Errorf("%s. Its NIC is detached, reattaching it to network %s with IP %s failed: %s", attachErr, prev.Network, prev.Ip, err)
+	}
+	if _, err := waitForVmState(d, meta, state); err != nil {
+		return fmt.Errorf("%s. Error waiting for virtual machine (%s) to reattach its NIC: %s", attachErr, d.Id(), err)
+	}
+
+	// the state keeps the NIC the VM still has
+	old, _ := d.GetChange("network")
+	d.Set("network", old)
+	d.Set("ip", prev.Ip)
+	log.Printf("[INFO] Successfully reattached VM %s to network %s with IP %s\n", d.Id(), prev.Network, prev.Ip)
+	return fmt.Errorf("%s. The NIC is reattached to network %s with IP %s", attachErr, prev.Network, prev.Ip)
+}
+
 func resourceVmDelete(d *schema.ResourceData, meta interface{}) error {
-	err := resourceVmRead(d, meta)
+	meta, err := vmClient(d.Get("endpoint").(string), meta)
+	if err != nil {
+		return err
+	}
+
+	err = resourceVmRead(d, meta)
 	if err != nil || d.Id() == "" {
 		return err
 	}
 
 	client := meta.(*Client)
-	resp, err := client.Call("one.vm.action", "terminate-hard", intId(d.Id()))
-	if err != nil {
+	action := d.Get("delete_action").(string)
+	if state := vmDeleteStates[action]; state != "done" {
+		resp, err := client.Call("one.vm.action", action, intId(d.Id()))
+		if err != nil {
+			return err
+		}
+		if _, err = waitForVmState(d, meta, state); err != nil {
+			return fmt.Errorf(
+				"Error waiting for virtual machine (%s) to be in state %s: %s", d.Id(), strings.ToUpper(state), err)
+		}
+
+		// the VM keeps its leases, including the ones of the floating IPs
+		log.Printf("[INFO] Successfully left VM %s in state %s\n", resp, state)
+		return nil
+	}
+
+	// sent along with the actions of the other VMs being deleted
+	if err = client.terminateVm(intId(d.Id()), action); err != nil {
 		return err
 	}
 
-	_, err = waitForVmState(d, meta, "done")
-	if err != nil {
-		return fmt.Errorf(
-			"Error waiting for virtual machine (%s) to be in state DONE: %s", d.Id(), err)
+	log.Printf("[INFO] Successfully terminated VM %s\n", d.Id())
+
+	// the leases of the VM are free now, keep other VMs from taking the floating IPs
+	for _, v := range d.Get("floating_ip").([]interface{}) {
+		floatingIp := v.(map[string]interface{})
+		if err = holdFloatingIp(client, floatingIp["network"].(string), floatingIp["ip"].(string)); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("[INFO] Successfully terminated VM %s\n", resp)
 	return nil
 }
 
+// vmDeleteStates maps each delete_action to the state the VM is left in
+var vmDeleteStates = map[string]string{
+	"terminate-hard": "done",
+	"terminate":      "done",
+	"undeploy-hard":  "undeployed",
+	"poweroff-hard":  "poweroff",
+}
+
+// errVmBootFailure stops waiting for a VM that won't get anywhere without being recovered
+var errVmBootFailure = errors.New("VM is in LCM state BOOT_FAILURE")
+
 func waitForVmState(d *schema.ResourceData, meta interface{}, state string) (interface{}, error) {
 	var vm *UserVm
 	client := meta.(*Client)
 
-	log.Printf("Waiting for VM (%s) to be in state Done", d.Id())
+	log.Printf("Waiting for VM (%s) to be in state %s", d.Id(), state)
 
 	stateConf := &resource.StateChangeConf{
 		Pending: []string{"anythingelse"},
@@ -490,17 +4117,33 @@ func waitForVmState(d *schema.ResourceData, meta interface{}, state string) (int
 				}
 			}
 			log.Printf("VM is currently in state %v and in LCM state %v", vm.State, vm.LcmState)
-			if vm.State == 3 && vm.LcmState == 3 {
+			if d.Get("record_lifecycle").(bool) {
+				recordLifecycle(d, vm)
+			}
+			// LCM states are only meaningful while the VM is ACTIVE
+			if vm.State == 3 && vmLcmState(state) == vm.LcmState {
+				return vm, state, nil
+			} else if vm.State == 3 && vm.LcmState == 36 {
+				return nil, "", errVmBootFailure
+			} else if vm.State == 3 && vm.LcmState == 3 && vmDeployLcmStates[state] {
+				// the VM may pass the states of its deployment between two polls
+				return vm, state, nil
+			} else if vm.State == 3 && vm.LcmState == 3 && vmLcmState(state) < 0 {
+				// a wait for another LCM state passes through RUNNING
 				return vm, "running", nil
 			} else if vm.State == 6 {
 				return vm, "done", nil
+			} else if vm.State == 8 {
+				return vm, "poweroff", nil
+			} else if vm.State == 9 {
+				return vm, "undeployed", nil
 			} else {
 				return nil, "anythingelse", nil
 			}
 		},
-		Timeout:    10 * time.Minute,
+		Timeout:    client.OperationTimeout,
 		Delay:      10 * time.Second,
-		MinTimeout: 3 * time.Second,
+		MinTimeout: client.PollInterval,
 	}
 
 	return stateConf.WaitForState()
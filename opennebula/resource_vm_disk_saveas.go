@@ -0,0 +1,121 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// The disk of a VM saved as a new image. The resource ID is the one of the image, which is
+// deleted along with the resource.
+func resourceVmDiskSaveas() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVmDiskSaveasCreate,
+		Read:   resourceVmDiskSaveasRead,
+		Delete: resourceVmDiskSaveasDelete,
+
+		Schema: map[string]*schema.Schema{
+			"vm_id": {
+				Type:        schema.TypeInt,
+				Required:    true,
+				ForceNew:    true,
+				Description: "ID of the VM whose disk is saved",
+			},
+			"disk_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				ForceNew:    true,
+				Description: "ID of the disk to save, the boot disk by default",
+			},
+			"snapshot_id": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     -1,
+				ForceNew:    true,
+				Description: "ID of the disk snapshot to save instead of the current state of the disk",
+			},
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Name of the new image",
+			},
+			"type": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Type of the new image, e.g. OS or DATABLOCK. Defaults to the type of the disk's image",
+			},
+			"image_id": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "ID of the new image",
+			},
+		},
+	}
+}
+
+func resourceVmDiskSaveasCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	resp, err := client.Call(
+		"one.vm.disksaveas",
+		d.Get("vm_id"),
+		d.Get("disk_id"),
+		d.Get("name"),
+		d.Get("type"),
+		d.Get("snapshot_id"),
+	)
+	if err != nil {
+		return fmt.Errorf("Error saving disk %d of VM %d: %s", d.Get("disk_id"), d.Get("vm_id"), err)
+	}
+
+	d.SetId(resp)
+
+	if _, err = waitForImageState(d, meta, "ready"); err != nil {
+		return fmt.Errorf("Error waiting for Image (%s) of disk %d of VM %d to be in state READY: %s", d.Id(), d.Get("disk_id"), d.Get("vm_id"), err)
+	}
+
+	log.Printf("[INFO] Successfully saved disk %d of VM %d as Image %s\n", d.Get("disk_id"), d.Get("vm_id"), d.Id())
+	return resourceVmDiskSaveasRead(d, meta)
+}
+
+func resourceVmDiskSaveasRead(d *schema.ResourceData, meta interface{}) error {
+	var img *Image
+	client := meta.(*Client)
+
+	resp, err := client.Call("one.image.info", intId(d.Id()), false)
+	if err != nil {
+		if oneErr, ok := err.(*OpenNebulaError); ok && oneErr.Code == errorNoExists {
+			log.Printf("[WARNING] Image %s of disk %d of VM %d is gone", d.Id(), d.Get("disk_id"), d.Get("vm_id"))
+			d.SetId("")
+			return nil
+		}
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &img); err != nil {
+		return err
+	}
+
+	d.Set("name", img.Name)
+	d.Set("image_id", img.Id)
+	if _, ok := d.GetOk("type"); ok && img.Type >= 0 && img.Type < len(imageTypes) {
+		d.Set("type", imageTypes[img.Type])
+	}
+
+	return nil
+}
+
+func resourceVmDiskSaveasDelete(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	if _, err := client.Call("one.image.delete", intId(d.Id()), false); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deleted Image %s\n", d.Id())
+	return nil
+}
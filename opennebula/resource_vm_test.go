@@ -0,0 +1,882 @@
+package opennebula
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+var testRpcMethodRegexp = regexp.MustCompile(`<methodName>([^<]+)</methodName>`)
+
+// testRpcServer fakes oned: each call is answered by the handler registered for its method,
+// which returns the result of a successful call or an error for a failed one. The error code
+// of an *OpenNebulaError is passed on.
+// The names of all methods called are recorded in calls.
+func testRpcServer(t *testing.T, handlers map[string]func() (interface{}, error), calls *[]string) (*Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		method := testRpcMethodRegexp.FindStringSubmatch(string(body))[1]
+		if calls != nil {
+			*calls = append(*calls, method)
+		}
+
+		handler, ok := handlers[method]
+		if !ok {
+			t.Errorf("Unexpected call to %s", method)
+			handler = func() (interface{}, error) { return nil, fmt.Errorf("[%s] not implemented", method) }
+		}
+
+		success, value, code := "1", "", 0
+		result, err := handler()
+		if oneErr, ok := err.(*OpenNebulaError); ok {
+			code = oneErr.Code
+		}
+		if err != nil {
+			success, value = "0", testRpcString(err.Error())
+		} else if i, ok := result.(int); ok {
+			value = fmt.Sprintf("<value><i4>%d</i4></value>", i)
+		} else {
+			value = testRpcString(fmt.Sprintf("%v", result))
+		}
+
+		fmt.Fprintf(w, `<?xml version="1.0"?><methodResponse><params><param><value><array><data>`+
+			`<value><boolean>%s</boolean></value>%s<value><i4>%d</i4></value>`+
+			`</data></array></value></param></params></methodResponse>`, success, value, code)
+	}))
+
+	client, err := NewClient(server.URL, "dev", "secret")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return client, server.Close
+}
+
+func testRpcString(s string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(s))
+	return "<value><string>" + escaped.String() + "</string></value>"
+}
+
+func TestResourceVmRead_emptyName(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>base-42</NAME><UNAME>dev</UNAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT><NIC><NETWORK>net</NETWORK></NIC><DISK><IMAGE>img</IMAGE></DISK></TEMPLATE></VM>`
+	vmPool := `<VM_POOL><VM><ID>7</ID><NAME></NAME></VM></VM_POOL>`
+
+	var calls []string
+	vmExists := true
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) {
+			if !vmExists {
+				return nil, &OpenNebulaError{Code: errorNoExists, Message: "[one.vm.info] Error getting virtual machine [42]."}
+			}
+			return vmInfo, nil
+		},
+		"one.vmpool.info": func() (interface{}, error) { return vmPool, nil },
+	}, &calls)
+	defer stop()
+
+	// state right after creating a VM without a name
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"template_id": 1,
+		"image":       "img",
+		"network":     "net",
+	})
+	d.SetId("42")
+
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Id() != "42" || d.Get("instance").(string) != "base-42" {
+		t.Fatalf("Expected VM 42 named base-42 to be read, got %s named %s", d.Id(), d.Get("instance"))
+	}
+	if !strings.HasPrefix(d.Get("full_template").(string), "<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP>") {
+		t.Fatalf("Expected the template to be read verbatim, got %s", d.Get("full_template"))
+	}
+
+	// once the VM is gone, the unnamed VM of the pool must not be taken for it
+	vmExists = false
+	d.Set("instance", "")
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Id() != "" {
+		t.Fatalf("Expected the VM to be gone, but it was read as %s", d.Id())
+	}
+	for _, call := range calls {
+		if call == "one.vmpool.info" {
+			t.Fatalf("Expected no lookup by name, got calls %v", calls)
+		}
+	}
+}
+
+func TestResourceVmImportState_userTemplate(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT><NIC><NETWORK>net</NETWORK></NIC><DISK><IMAGE>img</IMAGE></DISK>
+		<CPU_COST>1.5</CPU_COST><MEMORY_COST>0.5</MEMORY_COST><DISK_COST>0.1</DISK_COST></TEMPLATE>
+		<USER_TEMPLATE><LABEL>frontend</LABEL><SECURITY_GROUPS>0,101</SECURITY_GROUPS><CPU_COST>1.5</CPU_COST>
+		<MEMORY_COST>0.5</MEMORY_COST><DISK_COST>0.1</DISK_COST><SCHED_REQUIREMENTS>CLUSTER_ID = 100</SCHED_REQUIREMENTS>
+		<SCHED_DS_REQUIREMENTS>ID = 101</SCHED_DS_REQUIREMENTS><SCHED_MESSAGE>No host</SCHED_MESSAGE>
+		<ERROR>Failed</ERROR><EXTERNAL_ID>crm-7</EXTERNAL_ID></USER_TEMPLATE></VM>`
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, nil)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	if _, err := resourceVmImportState(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// each user template attribute must end up in its own argument, not in metadata as well
+	for k, v := range map[string]interface{}{
+		"cpu_cost":              1.5,
+		"memory_cost":           0.5,
+		"disk_cost":             0.1,
+		"sched_requirements":    "CLUSTER_ID = 100",
+		"sched_ds_requirements": "ID = 101",
+		"external_id":           "crm-7",
+	} {
+		if d.Get(k) != v {
+			t.Fatalf("Expected %s to be imported as %v, got %v", k, v, d.Get(k))
+		}
+	}
+	if metadata := d.Get("metadata").(map[string]interface{}); len(metadata) != 1 || metadata["LABEL"] != "frontend" {
+		t.Fatalf("Expected only LABEL to be imported as metadata, got %v", metadata)
+	}
+	if ids := d.Get("security_group_ids").([]interface{}); len(ids) != 2 || ids[0] != 0 || ids[1] != 101 {
+		t.Fatalf("Expected security groups 0 and 101 to be imported, got %v", ids)
+	}
+}
+
+func TestResourceVmRead_persistentClone(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><TEMPLATE_ID>9</TEMPLATE_ID><DISK><IMAGE_ID>12</IMAGE_ID></DISK></TEMPLATE></VM>`
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, nil)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":             "web",
+		"template_id":      1,
+		"persistent_clone": true,
+	})
+	d.SetId("42")
+	d.Set("cloned_template_id", 9)
+
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Get("template_id").(int) != 1 {
+		t.Fatalf("Expected the configured template to be kept, got %d", d.Get("template_id"))
+	}
+}
+
+func TestParseAffinityRequirements(t *testing.T) {
+	for _, policy := range []string{"affinity", "anti-affinity"} {
+		requirements := affinityRequirements(policy, []int{3, 14})
+
+		parsedPolicy, vmIds, ok := parseAffinityRequirements(requirements)
+		if !ok || parsedPolicy != policy || len(vmIds) != 2 || vmIds[0] != 3 || vmIds[1] != 14 {
+			t.Fatalf("Could not parse %q back: %s %v %v", requirements, parsedPolicy, vmIds, ok)
+		}
+	}
+
+	if _, _, ok := parseAffinityRequirements(`CURRENT_VMS != 3 & HYPERVISOR = "kvm"`); ok {
+		t.Fatalf("Expected custom requirements not to be taken for an affinity")
+	}
+}
+
+func TestSchedActionTemplate(t *testing.T) {
+	var action *SchedAction
+	err := xml.Unmarshal([]byte(`<SCHED_ACTION><ID>2</ID><ACTION>backup</ACTION><TIME>1700000000</TIME>
+		<REPEAT>0</REPEAT><DAYS>1,5</DAYS><END_TYPE>2</END_TYPE><END_VALUE>1800000000</END_VALUE></SCHED_ACTION>`), &action)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := readSchedAction(action)
+	if config["id"] != 2 || config["repeat"] != "weekly" || config["days"] != "1,5" || config["end_time"] != "2027-01-15T08:00:00Z" {
+		t.Fatalf("Unexpected sched_action read: %v", config)
+	}
+
+	template := schedActionTemplate(config)
+	for _, attr := range []string{`TIME="1700000000"`, `REPEAT="0"`, `END_TYPE="2"`, `END_VALUE="1800000000"`} {
+		if !strings.Contains(template, attr) {
+			t.Fatalf("Expected %s in %q", attr, template)
+		}
+	}
+}
+
+func TestResourceVmUpdateSchedActions_inserted(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><USER_TEMPLATE>
+		<SCHED_ACTION><ID>3</ID><ACTION>backup</ACTION><TIME>1700003600</TIME><REPEAT>0</REPEAT><DAYS>1</DAYS><END_TYPE>0</END_TYPE></SCHED_ACTION>
+		<SCHED_ACTION><ID>4</ID><ACTION>poweroff</ACTION><TIME>1700007200</TIME></SCHED_ACTION></USER_TEMPLATE></VM>`
+
+	var calls []string
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info":        func() (interface{}, error) { return vmInfo, nil },
+		"one.vm.schedadd":    func() (interface{}, error) { return 42, nil },
+		"one.vm.schedupdate": func() (interface{}, error) { return 42, nil },
+	}, &calls)
+	defer stop()
+
+	// a block inserted first, the ids of the others shifted along with their position
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+	d.Set("sched_action", []interface{}{
+		map[string]interface{}{"id": 3, "action": "snapshot-create", "time": "2023-11-14T22:13:20Z"},
+		map[string]interface{}{"id": 4, "action": "backup", "time": "2023-11-14T23:13:20Z", "repeat": "weekly", "days": "1,5"},
+		map[string]interface{}{"id": 0, "action": "poweroff", "time": "2023-11-15T00:13:20Z"},
+	})
+
+	if err := resourceVmUpdateSchedActions(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if strings.Join(calls, " ") != "one.vm.info one.vm.schedadd one.vm.schedupdate" {
+		t.Fatalf("Expected the new action to be added and the backup to be updated only, got calls %v", calls)
+	}
+
+	vm := &UserVm{}
+	if err := xml.Unmarshal([]byte(vmInfo), vm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	actions := readSchedActions(d, vm)
+	if len(actions) != 2 || actions[0]["id"] != 3 || actions[1]["id"] != 4 {
+		t.Fatalf("Expected the backup and the poweroff to be read in their configured order, got %v", actions)
+	}
+}
+
+func TestResourceVmRead_swappedImage(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT><NIC><NETWORK>net</NETWORK></NIC>
+		<DISK><IMAGE>img</IMAGE><IMAGE_ID>7</IMAGE_ID></DISK></TEMPLATE></VM>`
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, nil)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"image_id":    5,
+		"network":     "net",
+	})
+	d.SetId("42")
+
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Get("image_id").(int) != 7 {
+		t.Fatalf("Expected the ID of the image actually backing the disk, got %d", d.Get("image_id"))
+	}
+}
+
+func TestResourceVmRead_costs(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT><NIC><NETWORK>net</NETWORK></NIC>
+		<DISK><IMAGE>img</IMAGE><IMAGE_ID>7</IMAGE_ID></DISK><CPU_COST>2</CPU_COST><MEMORY_COST>0.5</MEMORY_COST></TEMPLATE>
+		<USER_TEMPLATE><MEMORY_COST>0.25</MEMORY_COST></USER_TEMPLATE></VM>`
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, nil)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":        "web",
+		"template_id": 1,
+		"network":     "net",
+	})
+	d.SetId("42")
+
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Get("cpu_cost").(float64) != 2 || d.Get("memory_cost").(float64) != 0.5 || d.Get("disk_cost").(float64) != 0 {
+		t.Fatalf("Expected the costs of the template, which showback uses, got %v %v %v",
+			d.Get("cpu_cost"), d.Get("memory_cost"), d.Get("disk_cost"))
+	}
+}
+
+func TestResourceVmRead_noDiskOrNic(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>bare</NAME><STATE>8</STATE><LCM_STATE>0</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CPU>1</CPU><MEMORY>512</MEMORY></TEMPLATE></VM>`
+
+	calls := []string{}
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, &calls)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":        "bare",
+		"template_id": 1,
+	})
+	d.SetId("42")
+
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Get("image").(string) != "" || d.Get("network").(string) != "" || d.Get("ip").(string) != "" {
+		t.Fatalf("Expected empty disk, NIC and context arguments, got %q %q %q", d.Get("image"), d.Get("network"), d.Get("ip"))
+	}
+	if d.Get("memory").(int) != 512 {
+		t.Fatalf("Expected the rest of the VM to be read, got memory %d", d.Get("memory"))
+	}
+	if len(calls) != 1 {
+		t.Fatalf("Expected no vnet to be looked up without a NIC, got calls %v", calls)
+	}
+}
+
+func TestResourceVmRead_templateInherited(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CONTEXT><ETH0_IP>10.0.0.2</ETH0_IP></CONTEXT><NIC><NETWORK>net</NETWORK></NIC>
+		<DISK><IMAGE>img</IMAGE><IMAGE_ID>7</IMAGE_ID></DISK><INPUT><TYPE>tablet</TYPE><BUS>usb</BUS></INPUT></TEMPLATE>
+		<USER_TEMPLATE><SCHED_DS_REQUIREMENTS>ID=100</SCHED_DS_REQUIREMENTS></USER_TEMPLATE></VM>`
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, nil)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"name":                  "web",
+		"template_id":           1,
+		"network":               "net",
+		"sched_ds_requirements": "ID=100",
+	})
+	d.SetId("42")
+	d.Set("template_inherited", []string{"input"})
+
+	if err := resourceVmRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if inputs := d.Get("input").([]interface{}); len(inputs) != 0 {
+		t.Fatalf("Expected the input of the template to be left out, got %v", inputs)
+	}
+	if d.Get("sched_ds_requirements").(string) != "ID=100" {
+		t.Fatalf("Expected the configured datastore requirements to be read, got %q", d.Get("sched_ds_requirements"))
+	}
+}
+
+func TestResourceVmRead_networkRouting(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><NAME>web</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+		<PERMISSIONS><OWNER_U>1</OWNER_U><OWNER_M>1</OWNER_M></PERMISSIONS>
+		<TEMPLATE><CONTEXT><ETH0_IP>10.0.1.2</ETH0_IP></CONTEXT>
+		<NIC><NETWORK>net</NETWORK><NETWORK_ID>3</NETWORK_ID><AR_ID>1</AR_ID><MAC>02:00:0a:00:01:02</MAC></NIC>
+		<DISK><IMAGE>img</IMAGE><IMAGE_ID>7</IMAGE_ID></DISK></TEMPLATE></VM>`
+	vnInfo := `<VNET><ID>3</ID><TEMPLATE><GATEWAY>10.0.0.1</GATEWAY><DNS>10.0.0.53</DNS></TEMPLATE>
+		<AR_POOL><AR><AR_ID>0</AR_ID></AR><AR><AR_ID>1</AR_ID><GATEWAY>10.0.1.1</GATEWAY></AR></AR_POOL></VNET>`
+
+	calls := []string{}
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+		"one.vn.info": func() (interface{}, error) { return vnInfo, nil },
+	}, &calls)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+			"name":        "web",
+			"template_id": 1,
+			"network":     "net",
+		})
+		d.SetId("42")
+
+		if err := resourceVmRead(d, client); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if d.Get("network_gateway") != "10.0.1.1" || d.Get("network_dns") != "10.0.0.53" {
+			t.Fatalf("Expected the gateway of the address range and the DNS of the vnet, got %s %s",
+				d.Get("network_gateway"), d.Get("network_dns"))
+		}
+		if d.Get("network_parent_id").(int) != -1 {
+			t.Fatalf("Expected a vnet that isn't a reservation, got parent %d", d.Get("network_parent_id"))
+		}
+		if d.Get("network_mac") != "02:00:0a:00:01:02" {
+			t.Fatalf("Expected the MAC OpenNebula assigned, got %s", d.Get("network_mac"))
+		}
+	}
+
+	if strings.Count(strings.Join(calls, " "), "one.vn.info") != 1 {
+		t.Fatalf("Expected the vnet to be looked up once, got calls %v", calls)
+	}
+}
+
+func TestOsVector(t *testing.T) {
+	vm := &UserVm{VmTemplate: &VmTemplate{Raw: `<OS><ARCH>x86_64</ARCH><BOOT>disk0</BOOT><FIRMWARE_SECURE>YES</FIRMWARE_SECURE></OS>`}}
+
+	base, err := vmTemplateVector(vm, "OS")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os := osVector(base, map[string]interface{}{"firmware": "BIOS", "firmware_secure": false, "boot": ""})
+	expected := "OS = [\n ARCH=\"x86_64\",\n BOOT=\"disk0\",\n FIRMWARE=\"BIOS\" ]\n"
+	if os != expected {
+		t.Fatalf("Expected the other OS attributes to be kept: %q", os)
+	}
+}
+
+func TestTopologyVector(t *testing.T) {
+	topology := topologyVector(map[string]interface{}{
+		"pin_policy":       "CORE",
+		"sockets":          1,
+		"cores":            4,
+		"threads":          0,
+		"emulator_threads": "0-1",
+	})
+
+	expected := "TOPOLOGY = [\n CORES=\"4\",\n EMULATOR_THREADS=\"0-1\",\n PIN_POLICY=\"CORE\",\n SOCKETS=\"1\" ]\n"
+	if topology != expected {
+		t.Fatalf("Unexpected topology vector: %q", topology)
+	}
+}
+
+func TestRecordLifecycle(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"record_lifecycle": true,
+	})
+
+	recordLifecycle(d, &UserVm{State: 1})
+	recordLifecycle(d, &UserVm{State: 3, LcmState: 1})
+	recordLifecycle(d, &UserVm{State: 3, LcmState: 1})
+	for i := 0; i < lifecycleLogMax; i++ {
+		recordLifecycle(d, &UserVm{State: 3, LcmState: 2 + i%2})
+	}
+
+	entries := d.Get("lifecycle_log").([]interface{})
+	if len(entries) != lifecycleLogMax {
+		t.Fatalf("Expected the log to be capped at %d entries, got %d", lifecycleLogMax, len(entries))
+	}
+	if state := entries[0].(map[string]interface{})["state"]; state != "BOOT" {
+		t.Fatalf("Expected the oldest entries to be dropped, got %s first", state)
+	}
+	if state := entries[lifecycleLogMax-1].(map[string]interface{})["state"]; state != "RUNNING" {
+		t.Fatalf("Expected RUNNING last, got %s", state)
+	}
+}
+
+func TestWaitForVmState_throughRunning(t *testing.T) {
+	lcmStates := []int{2, 3, 3, 17}
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) {
+			lcmState := lcmStates[0]
+			if len(lcmStates) > 1 {
+				lcmStates = lcmStates[1:]
+			}
+			return fmt.Sprintf("<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>%d</LCM_STATE></VM>", lcmState), nil
+		},
+	}, nil)
+	defer stop()
+	client.PollInterval = 10 * time.Millisecond
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	vm, err := waitForVmState(d, client, "HOTPLUG")
+	if err != nil {
+		t.Fatalf("Expected the wait to pass through RUNNING, got: %s", err)
+	}
+	if lcmState := vm.(*UserVm).LcmState; lcmState != 17 {
+		t.Fatalf("Expected the VM in HOTPLUG, got LCM state %d", lcmState)
+	}
+}
+
+func TestWaitForVmState_passedDeployState(t *testing.T) {
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) {
+			return "<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM>", nil
+		},
+	}, nil)
+	defer stop()
+	client.OperationTimeout = 15 * time.Second
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{})
+	d.SetId("42")
+
+	if _, err := waitForVmState(d, client, "PROLOG"); err != nil {
+		t.Fatalf("Expected a RUNNING VM to have passed PROLOG, got: %s", err)
+	}
+}
+
+func TestTerminateVm_batch(t *testing.T) {
+	pools := []string{"<VM_POOL><VM><ID>7</ID></VM></VM_POOL>", "<VM_POOL></VM_POOL>"}
+	calls := []string{}
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.action": func() (interface{}, error) { return 0, nil },
+		"one.vmpool.info": func() (interface{}, error) {
+			pool := pools[0]
+			if len(pools) > 1 {
+				pools = pools[1:]
+			}
+			return pool, nil
+		},
+	}, &calls)
+	defer stop()
+	client.PollInterval = 50 * time.Millisecond
+	client.OperationTimeout = time.Second
+
+	errs := make(chan error, 2)
+	for _, id := range []int{5, 7} {
+		go func(id int) { errs <- client.terminateVm(id, "terminate") }(id)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Expected both VMs to be DONE, got: %s", err)
+		}
+	}
+
+	expected := "one.vm.action one.vm.action one.vmpool.info one.vmpool.info"
+	if strings.Join(calls, " ") != expected {
+		t.Fatalf("Expected both actions sent before a shared poll, got %v", calls)
+	}
+}
+
+func TestResourceVmReattachNic_withoutNic(t *testing.T) {
+	calls := []string{}
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) {
+			return "<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE></TEMPLATE></VM>", nil
+		},
+		"one.vm.attachnic": func() (interface{}, error) { return 42, nil },
+	}, &calls)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{"network": "net"})
+	d.SetId("42")
+
+	if err := resourceVmReattachNic(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if strings.Contains(strings.Join(calls, " "), "one.vm.detachnic") {
+		t.Fatalf("Expected only the new NIC to be attached, got calls %v", calls)
+	}
+}
+
+func TestDropVmContext(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><STATE>8</STATE><TEMPLATE><OS><ARCH>x86_64</ARCH></OS>
+		<GRAPHICS><TYPE>VNC</TYPE><LISTEN>0.0.0.0</LISTEN></GRAPHICS>
+		<CONTEXT><DISK_ID>1</DISK_ID><NETWORK>YES</NETWORK></CONTEXT></TEMPLATE></VM>`
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+		"one.vm.updateconf": func() (interface{}, error) {
+			vmInfo = `<VM><ID>42</ID><STATE>8</STATE><TEMPLATE><OS><ARCH>x86_64</ARCH></OS></TEMPLATE></VM>`
+			return 42, nil
+		},
+	}, nil)
+	defer stop()
+
+	vm := &UserVm{}
+	if err := xml.Unmarshal([]byte(vmInfo), vm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sent, err := vmUpdateconfTemplate(vm, map[string]string{"CONTEXT": ""})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(sent, "OS = [\n ARCH=\"x86_64\" ]") || !strings.Contains(sent, "LISTEN=\"0.0.0.0\"") {
+		t.Fatalf("Expected the sections not changed to be sent as they are, got %q", sent)
+	}
+	if strings.Contains(sent, "CONTEXT") {
+		t.Fatalf("Expected the context to be dropped, got %q", sent)
+	}
+
+	if err := dropVmContext(client, 42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// oned keeping the context has to fail the detach
+	vmInfo = `<VM><ID>42</ID><STATE>8</STATE><TEMPLATE><CONTEXT><DISK_ID>1</DISK_ID></CONTEXT></TEMPLATE></VM>`
+	client, stop = testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info":       func() (interface{}, error) { return vmInfo, nil },
+		"one.vm.updateconf": func() (interface{}, error) { return 42, nil },
+	}, nil)
+	defer stop()
+	if err := dropVmContext(client, 42); err == nil {
+		t.Fatalf("Expected an error for a context oned kept")
+	}
+}
+
+func TestResourceVmUpdateConf_running(t *testing.T) {
+	vmInfo := `<VM><ID>42</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE><GRAPHICS><TYPE>VNC</TYPE></GRAPHICS></TEMPLATE></VM>`
+
+	var calls []string
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vm.info": func() (interface{}, error) { return vmInfo, nil },
+	}, &calls)
+	defer stop()
+
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"graphics": []interface{}{map[string]interface{}{"type": "VNC", "passwd": "secret"}},
+	})
+	d.SetId("42")
+
+	if err := resourceVmUpdateConf(d, client); err == nil {
+		t.Fatalf("Expected the graphics of a running VM not to be changed, got calls %v", calls)
+	}
+}
+
+func TestDiskResizes(t *testing.T) {
+	olds := []interface{}{
+		map[string]interface{}{"image": "system", "size": 10240, "disk_id": 0, "grow_fs": "/"},
+		map[string]interface{}{"image": "scratch", "size": 2048, "disk_id": 1, "grow_fs": ""},
+	}
+	news := []interface{}{
+		map[string]interface{}{"image": "system", "size": 10240, "disk_id": 0, "grow_fs": "/"},
+		map[string]interface{}{"image": "scratch", "size": 4096, "disk_id": 1, "grow_fs": "/scratch"},
+	}
+
+	sizes, growFs := diskResizes(olds, news)
+	if len(sizes) != 1 || sizes[1] != 4096 {
+		t.Fatalf("Expected only the scratch disk to be resized, got %v", sizes)
+	}
+	if len(growFs) != 1 || growFs[0] != "/scratch" {
+		t.Fatalf("Expected only the filesystem of the resized disk to be grown, got %v", growFs)
+	}
+}
+
+func TestReadDataDisks(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"data_disk": []interface{}{
+			map[string]interface{}{"image_id": 12},
+			map[string]interface{}{"image_id": 11},
+		},
+	})
+	disks := []*Disk{
+		{DiskId: 0, ImageId: 7},
+		{DiskId: 2, ImageId: 11, Target: "vdc", Persistent: "YES"},
+		{DiskId: 3, ImageId: 12, Target: "vdb", Persistent: "YES"},
+	}
+
+	dataDisks := readDataDisks(d, disks)
+	if len(dataDisks) != 2 || dataDisks[0]["image_id"] != 12 || dataDisks[1]["disk_id"] != 2 {
+		t.Fatalf("Expected the data disks in the configured order without the boot disk, got %v", dataDisks)
+	}
+	if dataDisks[0]["target"] != "vdb" || dataDisks[0]["persistent"] != true {
+		t.Fatalf("Unexpected data disk read: %v", dataDisks[0])
+	}
+}
+
+func TestReadDataDisks_otherDisks(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"data_disk": []interface{}{
+			map[string]interface{}{"image_id": 12},
+		},
+	})
+	// a second disk of the template and a volatile swap disk, neither of them configured
+	disks := []*Disk{
+		{DiskId: 0, ImageId: 7},
+		{DiskId: 1, ImageId: 9, Target: "vdb"},
+		{DiskId: 2, Type: "swap", Target: "vdc"},
+		{DiskId: 3, ImageId: 12, Target: "vdd", Persistent: "YES"},
+	}
+
+	dataDisks := readDataDisks(d, disks)
+	if len(dataDisks) != 1 || dataDisks[0]["disk_id"] != 3 {
+		t.Fatalf("Expected only the configured data disk, got %v", dataDisks)
+	}
+}
+
+func TestReadDataDisks_bootFromNetwork(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"boot_from_network": true,
+		"data_disk": []interface{}{
+			map[string]interface{}{"image_id": 11},
+		},
+	})
+
+	dataDisks := readDataDisks(d, []*Disk{{DiskId: 0, ImageId: 11, Target: "vda", Persistent: "YES"}})
+	if len(dataDisks) != 1 || dataDisks[0]["disk_id"] != 0 {
+		t.Fatalf("Expected the first disk to be a data disk without a boot disk, got %v", dataDisks)
+	}
+}
+
+func TestVmQuotaExceeded(t *testing.T) {
+	// unlimited VMs, default CPU quota, 9 of 10 running VMs
+	quota := &VmQuota{Vms: "-2", VmsUsed: "9", Cpu: "-1", CpuUsed: "4", Memory: "4096", MemoryUsed: "1024",
+		RunningVms: "10", RunningVmsUsed: "9"}
+
+	defaults := &VmQuota{Cpu: "4"}
+
+	if name, _, _ := quota.exceeded(nil, 1, 1, 1024, true); name != "" {
+		t.Fatalf("Expected the VM to fit, got %s exceeded", name)
+	}
+	if name, used, limit := quota.exceeded(nil, 1, 1, 4096, true); name != "MEMORY" || used != 1024 || limit != 4096 {
+		t.Fatalf("Expected the MEMORY quota to be exceeded, got %s (%g/%g)", name, used, limit)
+	}
+	if name, used, limit := quota.exceeded(defaults, 1, 1, 1024, true); name != "CPU" || used != 4 || limit != 4 {
+		t.Fatalf("Expected the default CPU quota to be exceeded, got %s (%g/%g)", name, used, limit)
+	}
+
+	quota.RunningVmsUsed = "10"
+	if name, _, _ := quota.exceeded(nil, 1, 1, 1024, true); name != "RUNNING_VMS" {
+		t.Fatalf("Expected the RUNNING_VMS quota to be exceeded, got %q", name)
+	}
+	if name, _, _ := quota.exceeded(nil, 1, 1, 1024, false); name != "" {
+		t.Fatalf("Expected a VM that doesn't run not to count against RUNNING_VMS, got %s exceeded", name)
+	}
+}
+
+func TestVmByExternalId(t *testing.T) {
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vmpool.info": func() (interface{}, error) {
+			return `<VM_POOL>
+				<VM><ID>1</ID><NAME>web</NAME><USER_TEMPLATE><EXTERNAL_ID>other</EXTERNAL_ID></USER_TEMPLATE></VM>
+				<VM><ID>2</ID><NAME>web</NAME><USER_TEMPLATE><EXTERNAL_ID>web-prod</EXTERNAL_ID></USER_TEMPLATE></VM>
+			</VM_POOL>`, nil
+		},
+	}, nil)
+	defer stop()
+
+	vm, err := vmByExternalId(client, "web-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm == nil || vm.Id != "2" {
+		t.Fatalf("Expected VM 2 to be found by its external_id, got %#v", vm)
+	}
+
+	if vm, err = vmByExternalId(client, "missing"); err != nil || vm != nil {
+		t.Fatalf("Expected no VM for an unknown external_id, got %#v (%v)", vm, err)
+	}
+}
+
+func TestReadGuestNetwork(t *testing.T) {
+	nics := readGuestNetwork(map[string]string{
+		"ETH0_MAC": "02:00:0a:00:00:02", "ETH0_IP": "10.0.0.2", "ETH0_MASK": "255.255.255.0", "ETH0_GATEWAY": "10.0.0.1",
+		"ETH2_MAC": "02:00:0a:01:00:05", "ETH2_IP": "10.1.0.5",
+		"NETWORK": "YES",
+	})
+
+	if len(nics) != 2 || nics[0]["index"] != 0 || nics[1]["index"] != 2 {
+		t.Fatalf("Expected the NICs ETH0 and ETH2, got %v", nics)
+	}
+	if nics[0]["mask"] != "255.255.255.0" || nics[0]["gateway"] != "10.0.0.1" || nics[1]["ip"] != "10.1.0.5" {
+		t.Fatalf("Unexpected addressing: %v", nics)
+	}
+}
+
+func TestReadNics(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"template_id": 1,
+		"nic": []interface{}{
+			map[string]interface{}{"network": "front", "security_group_ids": []interface{}{100}},
+			map[string]interface{}{"network": "back", "context": []interface{}{map[string]interface{}{"gateway": "10.1.0.254"}}},
+		},
+		"security_group_ids": []interface{}{101},
+	})
+
+	client, stop := testRpcServer(t, map[string]func() (interface{}, error){
+		"one.vn.info": func() (interface{}, error) {
+			return `<VNET><ID>5</ID><TEMPLATE><GATEWAY>10.0.0.1</GATEWAY><DNS>10.0.0.53</DNS>
+				<SECURITY_GROUPS>0</SECURITY_GROUPS></TEMPLATE></VNET>`, nil
+		},
+	}, nil)
+	defer stop()
+
+	nics := readNics(d, client, []*Nic{
+		{NicId: 0, Network: "front", NetworkId: 5, Ip: "10.0.0.2", SecurityGroups: "0,100,101"},
+		{NicId: 1, Network: "vrrp", Ip: "10.0.0.10", Floating: "YES"},
+		{NicId: 2, Network: "back", NetworkId: 5, Ip: "10.1.0.2", SecurityGroups: "0,101,102", InboundAvgBw: 1000},
+	}, &Context{Attributes: map[string]string{"ETH0_GATEWAY": "10.0.0.254", "ETH1_GATEWAY": "10.1.0.254", "ETH1_MTU": "9000"}})
+
+	if len(nics) != 2 || nics[0]["network"] != "front" || nics[1]["network"] != "back" || nics[1]["nic_id"] != 2 {
+		t.Fatalf("Expected the NICs front and back without the floating IP, got %v", nics)
+	}
+	if fmt.Sprint(nics[0]["security_group_ids"]) != "[100]" || fmt.Sprint(nics[1]["security_group_ids"]) != "[102]" {
+		t.Fatalf("Expected the security groups of each NIC without the ones of the vnet and VM, got %v", nics)
+	}
+	if len(nics[0]["context"].([]map[string]interface{})) != 0 {
+		t.Fatalf("Expected no context for the first NIC, which doesn't configure one, got %v", nics[0]["context"])
+	}
+	if nicCtx := nics[1]["context"].([]map[string]interface{}); len(nicCtx) != 1 || nicCtx[0]["gateway"] != "10.1.0.254" || nicCtx[0]["mtu"] != 9000 {
+		t.Fatalf("Expected the ETH1 context for the second NIC, got %v", nics[1]["context"])
+	}
+	if bandwidth := nics[1]["bandwidth"].([]map[string]interface{}); len(bandwidth) != 1 || bandwidth[0]["inbound_avg_bw"] != 1000 {
+		t.Fatalf("Expected the bandwidth limits of the second NIC, got %v", nics[1]["bandwidth"])
+	}
+	if nics[1]["gateway"] != "10.0.0.1" || nics[1]["dns"] != "10.0.0.53" {
+		t.Fatalf("Expected the routing of the vnet for each NIC, got %v", nics)
+	}
+}
+
+func TestNicBlocksContext(t *testing.T) {
+	context := nicBlocksContext([]interface{}{
+		map[string]interface{}{"context": []interface{}{}},
+		map[string]interface{}{"context": []interface{}{map[string]interface{}{"dns": "10.1.0.53", "gateway": "10.1.0.1", "mtu": 0}}},
+	})
+
+	if len(context) != 2 || context["ETH1_DNS"] != "10.1.0.53" || context["ETH1_GATEWAY"] != "10.1.0.1" {
+		t.Fatalf("Expected the context of the second NIC as ETH1, got %v", context)
+	}
+}
+
+func TestNicVector(t *testing.T) {
+	nic := map[string]interface{}{
+		"network":            "front",
+		"network_uname":      "",
+		"ip":                 "",
+		"security_group_ids": []interface{}{100, 101},
+		"search_domain":      "",
+		"bandwidth":          []interface{}{map[string]interface{}{"inbound_avg_bw": 1000, "inbound_peak_bw": 0, "inbound_peak_kb": 0, "outbound_avg_bw": 0, "outbound_peak_bw": 0, "outbound_peak_kb": 0}},
+		"raw":                "<driver queues='4'/>",
+	}
+
+	expected := "NIC = [\n INBOUND_AVG_BW=\"1000\",\n NETWORK=\"front\",\n RAW=\"<driver queues='4'/>\",\n SECURITY_GROUPS=\"100,101,102\" ]\n"
+	if vector := nicVector(nic, []interface{}{101, 102}); vector != expected {
+		t.Fatalf("Expected the security groups of the VM merged in, got %q", vector)
+	}
+}
+
+func TestNetworkNicArray(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVm().Schema, map[string]interface{}{
+		"template_id":           1,
+		"network":               "net",
+		"network_search_domain": "example.com",
+		"security_group_id":     100,
+	})
+
+	nic := strings.Join(networkNicArray(d), ",\n ")
+	for _, attr := range []string{`SEARCH_DOMAIN="example.com"`, `SECURITY_GROUPS="100"`} {
+		if !strings.Contains(nic, attr) {
+			t.Fatalf("Expected %s in the NIC, got %q", attr, nic)
+		}
+	}
+}
+
+func TestDiskVector(t *testing.T) {
+	disk := diskVector(map[string]interface{}{
+		"image": "", "image_id": 0, "image_uname": "", "image_driver": "qcow2", "size": 10240, "target": "vdb",
+		"readonly": true, "raw": "<iotune/>",
+	}, "vd")
+
+	expected := "DISK = [\n DEV_PREFIX=\"vd\",\n DRIVER=\"qcow2\",\n IMAGE_ID=\"0\",\n RAW=\"<iotune/>\",\n READONLY=\"YES\",\n SIZE=\"10240\",\n TARGET=\"vdb\" ]\n"
+	if disk != expected {
+		t.Fatalf("Unexpected disk vector: %q", disk)
+	}
+}
@@ -16,14 +16,29 @@ type UserVnets struct {
 }
 
 type UserVnet struct {
-	Name        string       `xml:"NAME"`
-	Id          int          `xml:"ID"`
-	Uid         int          `xml:"UID"`
-	Gid         int          `xml:"GID"`
-	Uname       string       `xml:"UNAME"`
-	Gname       string       `xml:"GNAME"`
-	Permissions *Permissions `xml:"PERMISSIONS"`
-	Bridge      string       `xml:"BRIDGE"`
+	Name        string          `xml:"NAME"`
+	Id          int             `xml:"ID"`
+	Uid         int             `xml:"UID"`
+	Gid         int             `xml:"GID"`
+	Uname       string          `xml:"UNAME"`
+	Gname       string          `xml:"GNAME"`
+	Permissions *Permissions    `xml:"PERMISSIONS"`
+	Bridge      string          `xml:"BRIDGE"`
+	PhyDev      string          `xml:"PHYDEV"`
+	VnMad       string          `xml:"VN_MAD"`
+	VlanId      string          `xml:"VLAN_ID"`
+	UsedLeases  int             `xml:"USED_LEASES"`
+	Ars         []*AddressRange `xml:"AR_POOL>AR"`
+	// Defaults for the leases of all address ranges
+	Gateway     string `xml:"TEMPLATE>GATEWAY"`
+	Dns         string `xml:"TEMPLATE>DNS"`
+	NetworkMask string `xml:"TEMPLATE>NETWORK_MASK"`
+	// Applied to the NICs attached to the vnet
+	Mtu               int    `xml:"TEMPLATE>MTU"`
+	FilterIpSpoofing  string `xml:"TEMPLATE>FILTER_IP_SPOOFING"`
+	FilterMacSpoofing string `xml:"TEMPLATE>FILTER_MAC_SPOOFING"`
+	// Security groups applied to all NICs in the vnet
+	SecurityGroups string `xml:"TEMPLATE>SECURITY_GROUPS"`
 }
 
 func resourceVnet() *schema.Resource {
@@ -98,20 +113,143 @@ func resourceVnet() *schema.Resource {
 				Required:    true,
 				Description: "Name of the bridge interface to which the vnet should be associated",
 			},
-			"ip_start": {
+			"physical_device": {
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "Start IP of the range to be allocated",
+				Optional:    true,
+				Computed:    true,
+				Description: "Name of the host interface the bridge is attached to, for drivers other than 'bridge' and 'dummy'",
 			},
-			"ip_size": {
+			"vn_mad": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Network driver of the vnet, e.g. 'bridge', '802.1Q', 'vxlan' or 'ovswitch'",
+			},
+			"gateway": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Default gateway of the leases, unless their address range sets one",
+			},
+			"dns": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "DNS servers of the leases, space separated, unless their address range sets them",
+			},
+			"network_mask": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Network mask of the leases, e.g. '255.255.255.0'",
+			},
+			"mtu": {
 				Type:        schema.TypeInt,
-				Required:    true,
-				Description: "Size (in number) of the ip range",
+				Optional:    true,
+				Computed:    true,
+				Description: "MTU of the NICs attached to the vnet, the one of the bridge by default",
+			},
+			"ip_spoofing": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Drop traffic from attached NICs with a source IP other than their lease",
+			},
+			"mac_spoofing": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Drop traffic from attached NICs with a source MAC other than their own",
+			},
+			"vlan_id": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "VLAN ID of the vnet, for the drivers tagging its traffic. 'auto' lets the driver assign one",
+			},
+			"automatic_vlan_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "VLAN ID the driver assigned, if 'vlan_id' is 'auto'",
+			},
+			"security_group_ids": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				Description: "IDs of the security groups applied to every NIC attached to the vnet",
+				Elem: &schema.Schema{
+					Type: schema.TypeInt,
+				},
+			},
+			"ip_start": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"ar"},
+				Description:   "Start IP of the range to be allocated. Either 'ip_start' and 'ip_size' or 'ar' is required",
+			},
+			"ip_size": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ConflictsWith: []string{"ar"},
+				Description:   "Size (in number) of the ip range",
 			},
 			"reservation_size": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ConflictsWith: []string{"ar"},
+				Description:   "Carve a network reservation of this size from the reservation starting from `ip-start`",
+			},
+			"ar": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{"ip_start", "ip_size", "reservation_size"},
+				Description:   "Address ranges of the vnet, for a vnet with several of them or other than IPv4. Lists all address ranges of the vnet if unset",
+				Elem: &schema.Resource{
+					Schema: addressRangeSchema(),
+				},
+			},
+			"total_leases": {
 				Type:        schema.TypeInt,
-				Optional:    true,
-				Description: "Carve a network reservation of this size from the reservation starting from `ip-start`",
+				Computed:    true,
+				Description: "Number of addresses in all address ranges of the vnet",
+			},
+			"used_leases": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Number of addresses leased to VMs, held or reserved",
+			},
+			"free_leases": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Number of addresses left for new leases",
+			},
+			"ar_leases": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Lease counts of each address range of the vnet",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"ar_id": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "ID of the address range",
+						},
+						"total_leases": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Number of addresses in the address range",
+						},
+						"used_leases": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Number of addresses of the address range in use",
+						},
+						"free_leases": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Number of addresses of the address range left",
+						},
+					},
+				},
 			},
 		},
 	}
@@ -119,11 +257,26 @@ func resourceVnet() *schema.Resource {
 
 func resourceVnetCreate(d *schema.ResourceData, meta interface{}) error {
 	client := meta.(*Client)
+	_, byIpStart := d.GetOk("ip_start")
+	if _, ok := d.GetOk("ar"); !ok && !byIpStart {
+		return fmt.Errorf("One of ip_start or ar is required")
+	}
+
+	vlan := ""
+	if value, ok := d.GetOk("vlan_id"); ok {
+		vlan = "\n" + strings.TrimSuffix(vlanTemplate(value.(string)), "\n")
+	}
+	securityGroups := ""
+	if value, ok := d.GetOk("security_group_ids"); ok {
+		securityGroups = fmt.Sprintf("\nSECURITY_GROUPS = \"%s\"", idListString(value.([]interface{})))
+	}
+
 	// Create base object
 	resp, err := client.Call(
 		"one.vn.allocate",
 		fmt.Sprintf("NAME = \"%s\"\n",
-			d.Get("name").(string))+d.Get("description").(string)+"\nBRIDGE="+d.Get("bridge").(string),
+			d.Get("name").(string))+d.Get("description").(string)+"\nBRIDGE="+d.Get("bridge").(string)+vlan+securityGroups+
+			"\n"+vnetDriverTemplate(d)+vnetLeaseTemplate(d)+vnetNicTemplate(d),
 		-1,
 	)
 	if err != nil {
@@ -135,6 +288,25 @@ func resourceVnetCreate(d *schema.ResourceData, meta interface{}) error {
 	if _, err = changePermissions(intId(d.Id()), permission(d.Get("permissions").(string)), client, "one.vn.chmod"); err != nil {
 		return err
 	}
+	// add the address ranges of the ar blocks, recording the ID each one got
+	if !byIpStart {
+		ars := []interface{}{}
+		for _, v := range d.Get("ar").([]interface{}) {
+			ar := v.(map[string]interface{})
+			id, err := addAddressRange(client, intId(d.Id()), ar)
+			if err != nil {
+				return err
+			}
+			ar["ar_id"] = id
+			ars = append(ars, ar)
+		}
+		if err = d.Set("ar", ars); err != nil {
+			return err
+		}
+
+		return resourceVnetRead(d, meta)
+	}
+
 	// add address range and reservations
 	var address_range_string = `AR = [
   TYPE = IP4,
@@ -228,11 +400,69 @@ func resourceVnetRead(d *schema.ResourceData, meta interface{}) error {
 	d.Set("uname", vn.Uname)
 	d.Set("gname", vn.Gname)
 	d.Set("bridge", vn.Bridge)
+	d.Set("physical_device", vn.PhyDev)
+	d.Set("vn_mad", vn.VnMad)
+	d.Set("gateway", vn.Gateway)
+	d.Set("dns", vn.Dns)
+	d.Set("network_mask", vn.NetworkMask)
+	d.Set("mtu", vn.Mtu)
+	d.Set("ip_spoofing", vn.FilterIpSpoofing == "YES")
+	d.Set("mac_spoofing", vn.FilterMacSpoofing == "YES")
+	// the assigned VLAN ID differs from the configured one
+	if d.Get("vlan_id").(string) == "auto" {
+		d.Set("automatic_vlan_id", vn.VlanId)
+	} else {
+		d.Set("vlan_id", vn.VlanId)
+		d.Set("automatic_vlan_id", "")
+	}
+	// OpenNebula adds the default security group 0 to every vnet, which is ignored unless asked for
+	keepDefault := true
+	if value, ok := d.GetOk("security_group_ids"); ok {
+		keepDefault = false
+		for _, id := range value.([]interface{}) {
+			keepDefault = keepDefault || id.(int) == 0
+		}
+	}
+	securityGroupIds := []int{}
+	for _, id := range parseIdList(vn.SecurityGroups) {
+		if id != 0 || keepDefault {
+			securityGroupIds = append(securityGroupIds, id)
+		}
+	}
+	d.Set("security_group_ids", securityGroupIds)
 	d.Set("permissions", permissionString(vn.Permissions))
 
+	if err := d.Set("ar", readAddressRanges(d.Get("ar").([]interface{}), vn.Ars)); err != nil {
+		return err
+	}
+	if err := readVnetLeases(d, vn); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// readVnetLeases sets the lease counts of the vnet and each of its address ranges
+func readVnetLeases(d *schema.ResourceData, vn *UserVnet) error {
+	total, used := 0, 0
+	arLeases := []map[string]interface{}{}
+	for _, ar := range vn.Ars {
+		total += ar.Size
+		used += ar.UsedLeases
+		arLeases = append(arLeases, map[string]interface{}{
+			"ar_id":        ar.Id,
+			"total_leases": ar.Size,
+			"used_leases":  ar.UsedLeases,
+			"free_leases":  ar.Size - ar.UsedLeases,
+		})
+	}
+
+	d.Set("total_leases", total)
+	d.Set("used_leases", used)
+	d.Set("free_leases", total-used)
+	return d.Set("ar_leases", arLeases)
+}
+
 func resourceVnetExists(d *schema.ResourceData, meta interface{}) (bool, error) {
 	err := resourceVnetRead(d, meta)
 	if err != nil || d.Id() == "" {
@@ -246,15 +476,73 @@ func resourceVnetUpdate(d *schema.ResourceData, meta interface{}) error {
 	client := meta.(*Client)
 
 	if d.HasChange("description") {
+		// the lease defaults, NIC settings, driver, VLAN and security groups live in the same template
+		template := d.Get("description").(string) + "\n" + vnetLeaseTemplate(d) + vnetNicTemplate(d) + vnetDriverTemplate(d)
+		if value, ok := d.GetOk("bridge"); ok {
+			template += fmt.Sprintf("BRIDGE = \"%s\"\n", value)
+		}
+		if value, ok := d.GetOk("vlan_id"); ok {
+			template += vlanTemplate(value.(string))
+			if assigned := d.Get("automatic_vlan_id").(string); value == "auto" && assigned != "" {
+				template += fmt.Sprintf("VLAN_ID = \"%s\"\n", assigned)
+			}
+		}
+		if value, ok := d.GetOk("security_group_ids"); ok {
+			template += fmt.Sprintf("SECURITY_GROUPS = \"%s\"\n", idListString(value.([]interface{})))
+		}
 		_, err := client.Call(
 			"one.vn.update",
 			intId(d.Id()),
-			d.Get("description").(string),
+			template,
 			0, // replace the whole vnet instead of merging it with the existing one
 		)
 		if err != nil {
 			return err
 		}
+	} else if d.HasChange("gateway") || d.HasChange("dns") || d.HasChange("network_mask") {
+		_, err := client.Call(
+			"one.vn.update",
+			intId(d.Id()),
+			vnetLeaseTemplate(d),
+			1, // merge with the existing vnet
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated gateway, DNS and network mask of Vnet %s\n", d.Id())
+	}
+
+	// applied to the NICs attached from now on, running VMs keep theirs until they're redeployed
+	if !d.HasChange("description") && (d.HasChange("mtu") || d.HasChange("ip_spoofing") || d.HasChange("mac_spoofing")) {
+		_, err := client.Call(
+			"one.vn.update",
+			intId(d.Id()),
+			vnetNicTemplate(d),
+			1, // merge with the existing vnet
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated MTU and spoofing filters of Vnet %s\n", d.Id())
+	}
+
+	if d.HasChange("bridge") || d.HasChange("vlan_id") || d.HasChange("physical_device") {
+		if err := resourceVnetUpdateBridge(d, meta); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("security_group_ids") {
+		resp, err := client.Call(
+			"one.vn.update",
+			intId(d.Id()),
+			fmt.Sprintf("SECURITY_GROUPS = \"%s\"\n", idListString(d.Get("security_group_ids").([]interface{}))),
+			1, // merge with the existing vnet
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated security groups of Vnet %s\n", resp)
 	}
 
 	if d.HasChange("name") {
@@ -269,6 +557,12 @@ func resourceVnetUpdate(d *schema.ResourceData, meta interface{}) error {
 		log.Printf("[INFO] Successfully updated name for Vnet %s\n", resp)
 	}
 
+	if d.HasChange("ar") {
+		if err := resourceVnetUpdateArs(d, meta); err != nil {
+			return err
+		}
+	}
+
 	if d.HasChange("ip_size") {
 		var address_range_string = `AR = [
 		AR_ID = 0,
@@ -302,6 +596,88 @@ func resourceVnetUpdate(d *schema.ResourceData, meta interface{}) error {
 	return nil
 }
 
+// resourceVnetUpdateBridge changes the bridge, physical device and VLAN of the vnet in place.
+// OpenNebula only accepts this while no VM holds a lease, otherwise the vnet has to be recreated.
+func resourceVnetUpdateBridge(d *schema.ResourceData, meta interface{}) error {
+	var vn *UserVnet
+	client := meta.(*Client)
+
+	template := fmt.Sprintf("BRIDGE = \"%s\"\n", d.Get("bridge"))
+	if value, ok := d.GetOk("physical_device"); ok {
+		template += fmt.Sprintf("PHYDEV = \"%s\"\n", value)
+	}
+	if d.HasChange("vlan_id") {
+		template += vlanTemplate(d.Get("vlan_id").(string))
+	}
+
+	_, err := client.Call(
+		"one.vn.update",
+		intId(d.Id()),
+		template,
+		1, // merge with the existing vnet
+	)
+	if err == nil {
+		log.Printf("[INFO] Successfully updated bridge, physical device and VLAN of Vnet %s\n", d.Id())
+		return nil
+	}
+
+	resp, infoErr := client.Call("one.vn.info", intId(d.Id()), false)
+	if infoErr == nil && xml.Unmarshal([]byte(resp), &vn) == nil && vn.UsedLeases > 0 {
+		return fmt.Errorf(
+			"Cannot change bridge, physical device or VLAN of Vnet %s while %d leases are in use: detach the VMs or taint the vnet to recreate it (%s)",
+			d.Id(), vn.UsedLeases, err)
+	}
+
+	return err
+}
+
+// vnetDriverTemplate renders the network driver of the vnet and the device it uses
+func vnetDriverTemplate(d *schema.ResourceData) string {
+	template := ""
+	if value, ok := d.GetOk("vn_mad"); ok {
+		template += fmt.Sprintf("VN_MAD = \"%s\"\n", value)
+	}
+	if value, ok := d.GetOk("physical_device"); ok {
+		template += fmt.Sprintf("PHYDEV = \"%s\"\n", value)
+	}
+
+	return template
+}
+
+// vnetLeaseTemplate renders the defaults the leases of the vnet are configured with
+func vnetLeaseTemplate(d *schema.ResourceData) string {
+	template := ""
+	for _, arg := range []string{"gateway", "dns", "network_mask"} {
+		if value, ok := d.GetOk(arg); ok {
+			template += fmt.Sprintf("%s = \"%s\"\n", strings.ToUpper(arg), value)
+		}
+	}
+
+	return template
+}
+
+// vnetNicTemplate renders the MTU and the spoofing filters of the NICs attached to the vnet
+func vnetNicTemplate(d *schema.ResourceData) string {
+	template := ""
+	if value, ok := d.GetOk("mtu"); ok {
+		template += fmt.Sprintf("MTU = \"%d\"\n", value)
+	}
+	filters := map[bool]string{true: "YES", false: "NO"}
+	template += fmt.Sprintf("FILTER_IP_SPOOFING = \"%s\"\n", filters[d.Get("ip_spoofing").(bool)])
+	template += fmt.Sprintf("FILTER_MAC_SPOOFING = \"%s\"\n", filters[d.Get("mac_spoofing").(bool)])
+
+	return template
+}
+
+// vlanTemplate renders the VLAN ID of the vnet, leaving it to the driver for 'auto'
+func vlanTemplate(vlanId string) string {
+	if vlanId == "auto" {
+		return "AUTOMATIC_VLAN_ID = \"YES\"\n"
+	}
+
+	return fmt.Sprintf("VLAN_ID = \"%s\"\nAUTOMATIC_VLAN_ID = \"NO\"\n", vlanId)
+}
+
 func resourceVnetDelete(d *schema.ResourceData, meta interface{}) error {
 	err := resourceVnetRead(d, meta)
 	if err != nil || d.Id() == "" {
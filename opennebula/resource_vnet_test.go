@@ -8,9 +8,97 @@ import (
 	"testing"
 
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
+func TestReadVnetLeases(t *testing.T) {
+	var vn *UserVnet
+	resp := `<VNET><ID>3</ID><AR_POOL>
+		<AR><AR_ID>0</AR_ID><SIZE>10</SIZE><USED_LEASES>4</USED_LEASES></AR>
+		<AR><AR_ID>2</AR_ID><SIZE>6</SIZE><USED_LEASES>6</USED_LEASES></AR>
+	</AR_POOL></VNET>`
+	if err := xml.Unmarshal([]byte(resp), &vn); err != nil {
+		t.Fatal(err)
+	}
+
+	d := schema.TestResourceDataRaw(t, resourceVnet().Schema, map[string]interface{}{})
+	if err := readVnetLeases(d, vn); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Get("total_leases") != 16 || d.Get("used_leases") != 10 || d.Get("free_leases") != 6 {
+		t.Fatalf("Unexpected lease counts %v/%v/%v", d.Get("total_leases"), d.Get("used_leases"), d.Get("free_leases"))
+	}
+	if d.Get("ar_leases.1.ar_id") != 2 || d.Get("ar_leases.1.free_leases") != 0 {
+		t.Fatalf("Unexpected leases of address range 2: %v", d.Get("ar_leases.1"))
+	}
+}
+
+func TestReadAddressRanges(t *testing.T) {
+	known := []interface{}{
+		map[string]interface{}{"type": "IP4", "ip": "10.0.0.1", "mac": "02:00:0a:00:00:01", "size": 10, "global_prefix": "", "ar_id": 0},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.1.1", "mac": "02:00:0a:00:01:01", "size": 10, "global_prefix": "", "ar_id": 1},
+	}
+	// the second range was recreated as 3, the one with ID 2 was added outside of Terraform
+	ars := []*AddressRange{
+		{Id: 0, Type: "IP4", Ip: "10.0.0.1", Mac: "02:00:0a:00:00:01", Size: 10},
+		{Id: 2, Type: "ETHER", Mac: "02:00:00:00:00:01", Size: 5},
+		{Id: 3, Type: "IP4", Ip: "10.0.1.1", Mac: "02:00:0a:00:01:01", Size: 20},
+	}
+
+	list := readAddressRanges(known, ars)
+	if len(list) != 3 {
+		t.Fatalf("Expected 3 address ranges, got %v", list)
+	}
+	if list[0]["ar_id"] != 0 || list[1]["ar_id"] != 3 || list[1]["size"] != 20 {
+		t.Fatalf("Expected the known ranges in their order, the second one with ID 3, got %v", list)
+	}
+	if list[2]["ar_id"] != 2 || list[2]["type"] != "ETHER" {
+		t.Fatalf("Expected the range added outside of Terraform last, got %v", list[2])
+	}
+}
+
+func TestMatchAddressRanges(t *testing.T) {
+	olds := []interface{}{
+		map[string]interface{}{"type": "IP4", "ip": "10.0.0.1", "mac": "02:00:0a:00:00:01", "size": 10, "global_prefix": "", "ar_id": 0},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.1.1", "mac": "02:00:0a:00:01:01", "size": 10, "global_prefix": "", "ar_id": 1},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.2.1", "mac": "02:00:0a:00:02:01", "size": 10, "global_prefix": "", "ar_id": 2},
+	}
+	// the first block was removed: the others shift up, keeping the ar_id and mac of their position
+	news := []interface{}{
+		map[string]interface{}{"type": "IP4", "ip": "10.0.1.1", "mac": "02:00:0a:00:00:01", "size": 20, "global_prefix": "", "ar_id": 0},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.2.1", "mac": "", "size": 10, "global_prefix": "", "ar_id": 1},
+		map[string]interface{}{"type": "IP4", "ip": "10.0.3.1", "mac": "", "size": 10, "global_prefix": "", "ar_id": 2},
+	}
+
+	matched := matchAddressRanges(olds, news)
+	if !reflect.DeepEqual(matched, map[int]int{0: 1, 1: 2}) {
+		t.Fatalf("Expected the blocks matched by their first IP, got %v", matched)
+	}
+}
+
+func TestVnetTemplates(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVnet().Schema, map[string]interface{}{
+		"vn_mad":          "802.1Q",
+		"physical_device": "eth1",
+		"gateway":         "10.0.0.1",
+		"network_mask":    "255.255.255.0",
+		"mtu":             9000,
+		"ip_spoofing":     true,
+	})
+
+	if template := vnetDriverTemplate(d); template != "VN_MAD = \"802.1Q\"\nPHYDEV = \"eth1\"\n" {
+		t.Fatalf("Unexpected driver template %q", template)
+	}
+	if template := vnetLeaseTemplate(d); template != "GATEWAY = \"10.0.0.1\"\nNETWORK_MASK = \"255.255.255.0\"\n" {
+		t.Fatalf("Unexpected lease template %q", template)
+	}
+	if template := vnetNicTemplate(d); template != "MTU = \"9000\"\nFILTER_IP_SPOOFING = \"YES\"\nFILTER_MAC_SPOOFING = \"NO\"\n" {
+		t.Fatalf("Unexpected NIC template %q", template)
+	}
+}
+
 func TestAccVnet(t *testing.T) {
 	resource.Test(t, resource.TestCase{
 		PreCheck:     func() { testAccPreCheck(t) },
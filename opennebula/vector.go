@@ -0,0 +1,101 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Vector is an OpenNebula template vector attribute (e.g. CONTEXT = [ ... ]) or a whole
+// template, read without knowing which attributes it contains
+type Vector struct {
+	Pairs []*Pair `xml:",any"`
+}
+
+// Pair is a single attribute, or a vector attribute when it has Pairs of its own
+type Pair struct {
+	XMLName xml.Name
+	Value   string  `xml:",chardata"`
+	Pairs   []*Pair `xml:",any"`
+}
+
+// Map returns the single attributes of the vector
+func (v *Vector) Map() map[string]string {
+	attrs := map[string]string{}
+	for _, p := range v.Pairs {
+		if len(p.Pairs) == 0 {
+			attrs[p.XMLName.Local] = p.Value
+		}
+	}
+
+	return attrs
+}
+
+// Set replaces the value of all attributes with the given key, or adds it
+func (v *Vector) Set(key, value string) {
+	found := false
+	for _, p := range v.Pairs {
+		if p.XMLName.Local == key {
+			p.Value, p.Pairs = value, nil
+			found = true
+		}
+	}
+
+	if !found {
+		v.Pairs = append(v.Pairs, &Pair{XMLName: xml.Name{Local: key}, Value: value})
+	}
+}
+
+// Remove drops all attributes with the given key
+func (v *Vector) Remove(key string) {
+	pairs := []*Pair{}
+	for _, p := range v.Pairs {
+		if p.XMLName.Local != key {
+			pairs = append(pairs, p)
+		}
+	}
+
+	v.Pairs = pairs
+}
+
+// String renders the vector as a whole template, keeping the order of its attributes
+func (v *Vector) String() string {
+	lines := []string{}
+	for _, p := range v.Pairs {
+		if len(p.Pairs) == 0 {
+			lines = append(lines, fmt.Sprintf("%s = \"%s\"\n", p.XMLName.Local, escapeTemplateValue(p.Value)))
+			continue
+		}
+
+		attrs := []string{}
+		for _, a := range p.Pairs {
+			attrs = append(attrs, fmt.Sprintf("%s=\"%s\"", a.XMLName.Local, escapeTemplateValue(a.Value)))
+		}
+		lines = append(lines, p.XMLName.Local+" = [\n "+strings.Join(attrs, ",\n ")+" ]\n")
+	}
+
+	return strings.Join(lines, "")
+}
+
+// vectorString renders a vector attribute for a template, sorting its attributes so the
+// same map always results in the same template
+func vectorString(name string, attrs map[string]string) string {
+	keys := []string{}
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", k, escapeTemplateValue(attrs[k])))
+	}
+
+	return name + " = [\n " + strings.Join(pairs, ",\n ") + " ]\n"
+}
+
+// escapeTemplateValue escapes a value to be placed between double quotes in a template
+func escapeTemplateValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+}
@@ -0,0 +1,35 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestVector_roundTrip(t *testing.T) {
+	var v Vector
+	document := `<USER_TEMPLATE><COST_CENTER><![CDATA[ops]]></COST_CENTER>` +
+		`<SCHED_ACTION><ACTION><![CDATA[terminate]]></ACTION><TIME><![CDATA[1700000000]]></TIME></SCHED_ACTION>` +
+		`<NOTE><![CDATA[say "hi"]]></NOTE></USER_TEMPLATE>`
+	if err := xml.Unmarshal([]byte(document), &v); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	v.Set("COST_CENTER", "dev")
+	v.Set("MONITOR_GROUP", "web")
+
+	expected := `COST_CENTER = "dev"
+SCHED_ACTION = [
+ ACTION="terminate",
+ TIME="1700000000" ]
+NOTE = "say \"hi\""
+MONITOR_GROUP = "web"
+`
+	if v.String() != expected {
+		t.Fatalf("Expected template\n%s\ngot\n%s", expected, v.String())
+	}
+
+	v.Remove("NOTE")
+	if _, ok := v.Map()["NOTE"]; ok {
+		t.Fatalf("Expected NOTE to be removed")
+	}
+}
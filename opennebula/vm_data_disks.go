@@ -0,0 +1,155 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Data disks are persistent images attached to the VM besides the disk it boots from. They're
+// owned by whoever manages the image (e.g. an opennebula_image resource): the VM only attaches
+// and detaches them, OpenNebula keeps their data in the image when the VM is terminated.
+
+// dataDiskVector renders a data_disk block as a DISK vector, with the dev_prefix of the VM
+// unless the disk sets its own
+func dataDiskVector(disk map[string]interface{}, devPrefix string) string {
+	attrs := map[string]string{"IMAGE_ID": strconv.Itoa(disk["image_id"].(int))}
+	if disk["target"].(string) != "" {
+		attrs["TARGET"] = disk["target"].(string)
+	}
+	if disk["dev_prefix"].(string) != "" {
+		devPrefix = disk["dev_prefix"].(string)
+	}
+	if devPrefix != "" {
+		attrs["DEV_PREFIX"] = devPrefix
+	}
+
+	return vectorString("DISK", attrs)
+}
+
+// readDataDisks returns the data disks of the VM in the order they're configured in. Other disks,
+// e.g. the ones of the template or volatile disks, are left out: they aren't the VM's to detach.
+func readDataDisks(d *schema.ResourceData, disks []*Disk) []map[string]interface{} {
+	bootDisks := vmBootDisks(d.Get("disk").([]interface{}), d.Get("boot_from_network").(bool))
+	claimed := map[int]bool{}
+
+	list := []map[string]interface{}{}
+	for _, v := range d.Get("data_disk").([]interface{}) {
+		imageId := v.(map[string]interface{})["image_id"].(int)
+		for i, disk := range disks {
+			volatile := strings.ToLower(disk.Type) == "fs" || strings.ToLower(disk.Type) == "swap"
+			if i < bootDisks || volatile || claimed[disk.DiskId] || disk.ImageId != imageId {
+				continue
+			}
+			claimed[disk.DiskId] = true
+			list = append(list, map[string]interface{}{
+				"image_id":   disk.ImageId,
+				"target":     disk.Target,
+				"dev_prefix": disk.DevPrefix,
+				"disk_id":    disk.DiskId,
+				"persistent": disk.Persistent == "YES",
+			})
+			break
+		}
+	}
+
+	return list
+}
+
+// resourceVmUpdateDataDisks detaches the data disks no longer configured before attaching new ones.
+// A disk whose target changed is attached again.
+func resourceVmUpdateDataDisks(d *schema.ResourceData, meta interface{}, old, new []interface{}) error {
+	client := meta.(*Client)
+	devPrefix := d.Get("dev_prefix").(string)
+
+	toAttach := map[string]bool{}
+	for _, v := range new {
+		toAttach[dataDiskVector(v.(map[string]interface{}), devPrefix)] = true
+	}
+	for _, v := range old {
+		disk := v.(map[string]interface{})
+		key := dataDiskVector(disk, devPrefix)
+		if toAttach[key] {
+			delete(toAttach, key)
+			continue
+		}
+		if err := detachDataDisk(d, meta, disk["disk_id"].(int)); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range new {
+		disk := dataDiskVector(v.(map[string]interface{}), devPrefix)
+		if !toAttach[disk] {
+			continue
+		}
+
+		_, state, err := vmHotplugState(client, intId(d.Id()))
+		if err != nil {
+			return err
+		}
+		if _, err = client.Call("one.vm.attach", intId(d.Id()), disk); err != nil {
+			return err
+		}
+		if _, err = waitForVmState(d, meta, state); err != nil {
+			return fmt.Errorf("Error attaching image %d to virtual machine (%s): %s", v.(map[string]interface{})["image_id"], d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully attached image %d to VM %s\n", v.(map[string]interface{})["image_id"], d.Id())
+	}
+
+	return nil
+}
+
+func detachDataDisk(d *schema.ResourceData, meta interface{}, diskId int) error {
+	client := meta.(*Client)
+
+	_, state, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	if _, err = client.Call("one.vm.detach", intId(d.Id()), diskId); err != nil {
+		return err
+	}
+	if _, err = waitForVmState(d, meta, state); err != nil {
+		return fmt.Errorf("Error detaching disk %d from virtual machine (%s): %s", diskId, d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully detached disk %d from VM %s\n", diskId, d.Id())
+	return nil
+}
+
+// validateDataDisks makes sure data disks are persistent, a copy of any other image would be
+// deleted with the VM
+func validateDataDisks(d *schema.ResourceDiff, meta interface{}) error {
+	var image struct {
+		Persistent int `xml:"PERSISTENT"`
+	}
+
+	if !d.NewValueKnown("data_disk") {
+		return nil
+	}
+	client := meta.(*Client)
+
+	for _, v := range d.Get("data_disk").([]interface{}) {
+		imageId := v.(map[string]interface{})["image_id"].(int)
+		resp, err := client.Call("one.image.info", imageId, false)
+		if err != nil {
+			// the image may be created in the same run
+			log.Printf("[DEBUG] Not validating image %d: %s", imageId, err)
+			continue
+		}
+		if err = xml.Unmarshal([]byte(resp), &image); err != nil {
+			return err
+		}
+		if image.Persistent != 1 {
+			return fmt.Errorf("Image %d of %q is not persistent, its data would be lost with the VM", imageId, "data_disk")
+		}
+	}
+
+	return nil
+}
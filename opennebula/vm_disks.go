@@ -0,0 +1,185 @@
+package opennebula
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Disks of disk blocks, instead of the single disk of the image arguments. The VM is created
+// with all of them, booting from the first. Their size is changed in place, anything else requires
+// a new VM. Data disks are attached after them as before.
+
+func diskSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"image": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "Name of the image. Either 'image' or 'image_id' is required",
+		},
+		"image_id": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "ID of the image, unambiguous unlike its name",
+		},
+		"image_uname": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "Owner of the image",
+		},
+		"image_driver": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "Driver of the disk, e.g. raw or qcow2",
+		},
+		"size": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Computed:    true,
+			Description: "Size of the disk in MB, the size of the image by default. It can only grow",
+		},
+		"grow_fs": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Mount points (space separated) of the disk whose filesystem the guest grows on its next boot after the disk is resized",
+		},
+		"target": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "Device the disk is attached as, e.g. 'vdb'",
+		},
+		"readonly": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			ForceNew:    true,
+			Description: "Attach the disk read-only, e.g. for data shared by several VMs. Read-only disks can't be resized",
+		},
+		"raw": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    true,
+			Description: "Raw hypervisor specific data for the disk, passed on verbatim",
+		},
+		"disk_id": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "ID of the disk in the VM",
+		},
+	}
+}
+
+// diskVector renders a disk block as a DISK vector, with the dev_prefix of the VM
+func diskVector(disk map[string]interface{}, devPrefix string) string {
+	attrs := map[string]string{}
+	if disk["image"].(string) != "" {
+		attrs["IMAGE"] = disk["image"].(string)
+	} else {
+		attrs["IMAGE_ID"] = strconv.Itoa(disk["image_id"].(int))
+	}
+	for arg, attr := range map[string]string{"image_uname": "IMAGE_UNAME", "image_driver": "DRIVER", "target": "TARGET", "raw": "RAW"} {
+		if disk[arg].(string) != "" {
+			attrs[attr] = disk[arg].(string)
+		}
+	}
+	if disk["size"].(int) > 0 {
+		attrs["SIZE"] = strconv.Itoa(disk["size"].(int))
+	}
+	if disk["readonly"].(bool) {
+		attrs["READONLY"] = "YES"
+	}
+	if devPrefix != "" {
+		attrs["DEV_PREFIX"] = devPrefix
+	}
+
+	return vectorString("DISK", attrs)
+}
+
+// vmBootDisks returns how many disks the VM is created with, before any data disks. A VM booting
+// from the network has none.
+func vmBootDisks(disks []interface{}, bootFromNetwork bool) int {
+	if len(disks) > 0 {
+		return len(disks)
+	}
+	if bootFromNetwork {
+		return 0
+	}
+
+	return 1
+}
+
+// readDisks returns the disks of the disk blocks, the first ones of the VM
+func readDisks(d *schema.ResourceData, disks []*Disk) []map[string]interface{} {
+	list := []map[string]interface{}{}
+	for i, disk := range disks {
+		if i >= len(d.Get("disk").([]interface{})) {
+			break
+		}
+		list = append(list, map[string]interface{}{
+			"image":        disk.Image,
+			"image_id":     disk.ImageId,
+			"image_uname":  disk.ImageUname,
+			"image_driver": disk.ImageDriver,
+			"size":         disk.Size,
+			"grow_fs":      d.Get(fmt.Sprintf("disk.%d.grow_fs", i)),
+			"target":       disk.Target,
+			"readonly":     disk.ReadOnly == "YES",
+			"raw":          disk.Raw,
+			"disk_id":      disk.DiskId,
+		})
+	}
+
+	return list
+}
+
+// diskResizes returns the new size of each disk block whose size changed by its disk ID, and the
+// filesystems to grow on them
+func diskResizes(olds, news []interface{}) (map[int]int, []string) {
+	sizes := map[int]int{}
+	growFs := []string{}
+	// adding or removing disk blocks requires a new VM, so they're still in the same order
+	for i := 0; i < len(olds) && i < len(news); i++ {
+		prev, disk := olds[i].(map[string]interface{}), news[i].(map[string]interface{})
+		if prev["size"] == disk["size"] {
+			continue
+		}
+		sizes[prev["disk_id"].(int)] = disk["size"].(int)
+		if disk["grow_fs"].(string) != "" {
+			growFs = append(growFs, disk["grow_fs"].(string))
+		}
+	}
+
+	return sizes, growFs
+}
+
+// validateDisks makes sure the VM has an image to boot from, unless it boots from the network or
+// a persistent clone of its template, and each disk block names its image
+func validateDisks(d *schema.ResourceDiff) error {
+	_, byName := d.GetOk("image")
+	_, byId := d.GetOkExists("image_id")
+	known := d.NewValueKnown("image") && d.NewValueKnown("image_id") && d.NewValueKnown("disk")
+	if known && !byName && !byId && len(d.Get("disk").([]interface{})) == 0 &&
+		!d.Get("boot_from_network").(bool) && !d.Get("persistent_clone").(bool) {
+		return fmt.Errorf("One of %q, %q, %q or %q is required", "image", "image_id", "disk", "boot_from_network")
+	}
+
+	for i := range d.Get("disk").([]interface{}) {
+		_, byName := d.GetOk(fmt.Sprintf("disk.%d.image", i))
+		_, byId := d.GetOkExists(fmt.Sprintf("disk.%d.image_id", i))
+		if byName == byId {
+			return fmt.Errorf("Disk %d requires exactly one of %q or %q", i, "image", "image_id")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Floating IPs are leases held on a vnet (one.vn.hold), so no VM takes them by accident. While
+// attached to a VM the hold is released, and it's held again as soon as the NIC is detached so
+// another VM can take the IP over.
+
+// vnetIdByName returns the ID of the vnet with the given name
+func vnetIdByName(client *Client, name string) (int, error) {
+	var vns *UserVnets
+
+	resp, err := client.Call("one.vnpool.info", -2, -1, -1)
+	if err != nil {
+		return -1, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vns); err != nil {
+		return -1, err
+	}
+
+	for _, vn := range vns.UserVnet {
+		if vn.Name == name {
+			return vn.Id, nil
+		}
+	}
+
+	return -1, fmt.Errorf("Could not find vnet %s for user %s", name, client.Username)
+}
+
+// vmHotplugState returns the state the VM returns to once a hotplug operation finished
+func vmHotplugState(client *Client, id int) (*UserVm, string, error) {
+	var vm *UserVm
+
+	resp, err := client.Call("one.vm.info", id)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vm); err != nil {
+		return nil, "", err
+	}
+
+	if vm.State == 8 {
+		return vm, "poweroff", nil
+	}
+	return vm, "running", nil
+}
+
+func attachFloatingIp(d *schema.ResourceData, meta interface{}, network, ip string) error {
+	client := meta.(*Client)
+
+	vnId, err := vnetIdByName(client, network)
+	if err != nil {
+		return err
+	}
+	_, state, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	lease := fmt.Sprintf("LEASES=[IP=%s]", ip)
+	held := true
+	if _, err = client.Call("one.vn.release", vnId, lease); err != nil {
+		log.Printf("[WARNING] IP %s is not held on vnet %s, attaching it anyway: %s", ip, network, err)
+		held = false
+	}
+
+	attrs := map[string]string{"NETWORK": network, "IP": ip, "FLOATING": "YES"}
+	if securityGroups := idListString(d.Get("security_group_ids").([]interface{})); securityGroups != "" {
+		attrs["SECURITY_GROUPS"] = securityGroups
+	}
+	nic := vectorString("NIC", attrs)
+	if _, err = client.Call("one.vm.attachnic", intId(d.Id()), nic); err == nil {
+		_, err = waitForVmState(d, meta, state)
+	}
+	if err != nil {
+		if held {
+			if _, holdErr := client.Call("one.vn.hold", vnId, lease); holdErr != nil {
+				log.Printf("[WARNING] Could not hold IP %s on vnet %s again: %s", ip, network, holdErr)
+			}
+		}
+		return fmt.Errorf("Error attaching floating IP %s to virtual machine (%s): %s", ip, d.Id(), err)
+	}
+
+	log.Printf("[INFO] Successfully attached floating IP %s to VM %s\n", ip, d.Id())
+	return nil
+}
+
+func detachFloatingIp(d *schema.ResourceData, meta interface{}, network, ip string) error {
+	client := meta.(*Client)
+
+	vm, state, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+
+	for _, nic := range vm.VmTemplate.Nics {
+		if nic.Floating != "YES" || nic.Ip != ip {
+			continue
+		}
+
+		if _, err = client.Call("one.vm.detachnic", intId(d.Id()), nic.NicId); err != nil {
+			return err
+		}
+		if _, err = waitForVmState(d, meta, state); err != nil {
+			return fmt.Errorf("Error detaching floating IP %s from virtual machine (%s): %s", ip, d.Id(), err)
+		}
+	}
+
+	return holdFloatingIp(client, network, ip)
+}
+
+// resourceVmUpdateFloatingIps detaches the floating IPs no longer configured before attaching new ones
+func resourceVmUpdateFloatingIps(d *schema.ResourceData, meta interface{}, old, new []interface{}) error {
+	toAttach := map[string]bool{}
+	for _, v := range new {
+		floatingIp := v.(map[string]interface{})
+		toAttach[floatingIp["network"].(string)+"/"+floatingIp["ip"].(string)] = true
+	}
+	for _, v := range old {
+		floatingIp := v.(map[string]interface{})
+		key := floatingIp["network"].(string) + "/" + floatingIp["ip"].(string)
+		if toAttach[key] {
+			delete(toAttach, key)
+			continue
+		}
+		if err := detachFloatingIp(d, meta, floatingIp["network"].(string), floatingIp["ip"].(string)); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range new {
+		floatingIp := v.(map[string]interface{})
+		if !toAttach[floatingIp["network"].(string)+"/"+floatingIp["ip"].(string)] {
+			continue
+		}
+		if err := attachFloatingIp(d, meta, floatingIp["network"].(string), floatingIp["ip"].(string)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// holdFloatingIp holds the IP of a floating IP no VM has attached anymore
+func holdFloatingIp(client *Client, network, ip string) error {
+	vnId, err := vnetIdByName(client, network)
+	if err != nil {
+		return err
+	}
+
+	if _, err = client.Call("one.vn.hold", vnId, fmt.Sprintf("LEASES=[IP=%s]", ip)); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Successfully held floating IP %s on vnet %s\n", ip, network)
+	return nil
+}
+
+// floatingIps returns the floating IPs attached to the NICs of a VM
+func floatingIps(nics []*Nic) []map[string]interface{} {
+	ips := []map[string]interface{}{}
+	for _, nic := range nics {
+		if nic.Floating == "YES" {
+			ips = append(ips, map[string]interface{}{"network": nic.Network, "ip": nic.Ip})
+		}
+	}
+
+	return ips
+}
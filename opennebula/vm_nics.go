@@ -0,0 +1,243 @@
+package opennebula
+
+import (
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// NICs of nic blocks, instead of the single NIC of the network arguments. The VM is created with
+// all of them, changing them other than their context requires a new VM. Floating IPs are
+// attached on top as before.
+// The single NIC arguments conflict with them, except for security_group_ids which apply to all
+// NICs.
+
+func nicSchema() map[string]*schema.Schema {
+	// the limits are only set on create, unlike the ones of network_bandwidth
+	bandwidthSchema := nicBandwidthSchema()
+	for _, limit := range bandwidthSchema {
+		limit.ForceNew = true
+	}
+
+	return map[string]*schema.Schema{
+		"network": {
+			Type:        schema.TypeString,
+			Required:    true,
+			ForceNew:    true,
+			Description: "Name of the vnet",
+		},
+		"network_uname": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "Owner of the vnet",
+		},
+		"ip": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "IP to lease, a free one is picked otherwise",
+		},
+		"security_group_ids": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			Computed:    true,
+			ForceNew:    true,
+			Description: "IDs of security groups applied to the NIC besides the ones of the vnet and 'security_group_ids' of the VM",
+			Elem: &schema.Schema{
+				Type: schema.TypeInt,
+			},
+		},
+		"search_domain": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    true,
+			Description: "Search domain the guest configures for the NIC",
+		},
+		"bandwidth": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			ForceNew:    true,
+			MaxItems:    1,
+			Description: "Bandwidth limits of the NIC",
+			Elem: &schema.Resource{
+				Schema: bandwidthSchema,
+			},
+		},
+		"raw": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			ForceNew:    true,
+			Description: "Raw hypervisor specific data for the NIC, passed on verbatim",
+		},
+		"context": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			MaxItems:    1,
+			Description: "Network configuration the guest applies to the NIC, overriding the one of the vnet. Changes take effect on the next boot",
+			Elem: &schema.Resource{
+				Schema: nicContextSchema(),
+			},
+		},
+		"nic_id": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "ID of the NIC in the VM",
+		},
+		"mac": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "MAC address of the NIC",
+		},
+		"gateway": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Gateway of the NIC, as configured on the address range of its lease or the vnet",
+		},
+		"dns": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "DNS servers of the NIC, as configured on the address range of its lease or the vnet",
+		},
+	}
+}
+
+// nicVector renders a nic block as a NIC vector, with the security groups of the whole VM
+func nicVector(nic map[string]interface{}, vmSecurityGroups []interface{}) string {
+	attrs := map[string]string{"NETWORK": nic["network"].(string)}
+	if nic["network_uname"].(string) != "" {
+		attrs["NETWORK_UNAME"] = nic["network_uname"].(string)
+	}
+	if nic["ip"].(string) != "" {
+		attrs["IP"] = nic["ip"].(string)
+	}
+	ids := []interface{}{}
+	seen := map[int]bool{}
+	for _, id := range append(nic["security_group_ids"].([]interface{}), vmSecurityGroups...) {
+		if !seen[id.(int)] {
+			ids = append(ids, id)
+			seen[id.(int)] = true
+		}
+	}
+	if len(ids) > 0 {
+		attrs["SECURITY_GROUPS"] = idListString(ids)
+	}
+	if nic["search_domain"].(string) != "" {
+		attrs["SEARCH_DOMAIN"] = nic["search_domain"].(string)
+	}
+	if bandwidth := nic["bandwidth"].([]interface{}); len(bandwidth) > 0 && bandwidth[0] != nil {
+		for attr, value := range nicBandwidthVector(bandwidth[0].(map[string]interface{})) {
+			attrs[attr] = value
+		}
+	}
+	if nic["raw"].(string) != "" {
+		attrs["RAW"] = nic["raw"].(string)
+	}
+
+	return vectorString("NIC", attrs)
+}
+
+// nicBlocksContext returns the context attributes of the nic blocks, ETH<i> being the i-th block as
+// the VM is created with their NICs first
+func nicBlocksContext(nics []interface{}) map[string]string {
+	context := map[string]string{}
+	for i, v := range nics {
+		nicCtx := v.(map[string]interface{})["context"].([]interface{})
+		if len(nicCtx) == 0 || nicCtx[0] == nil {
+			continue
+		}
+		for k, value := range nicContext(i, nicCtx[0].(map[string]interface{})) {
+			context[k] = value
+		}
+	}
+
+	return context
+}
+
+// readNics returns the NICs of the VM other than floating IPs, in the order they were created in.
+// Of the security groups, the ones OpenNebula adds from the vnet and the VM are left out. The
+// context is read for the blocks configuring one.
+func readNics(d *schema.ResourceData, client *Client, nics []*Nic, context *Context) []map[string]interface{} {
+	configured := d.Get("nic").([]interface{})
+	vmSecurityGroups := map[int]bool{}
+	for _, id := range d.Get("security_group_ids").([]interface{}) {
+		vmSecurityGroups[id.(int)] = true
+	}
+
+	list := []map[string]interface{}{}
+	for _, nic := range nics {
+		if nic.Floating == "YES" {
+			continue
+		}
+
+		configuredGroups := []interface{}{}
+		nicCtx := []map[string]interface{}{}
+		if i := len(list); i < len(configured) {
+			block := configured[i].(map[string]interface{})
+			configuredGroups = block["security_group_ids"].([]interface{})
+			if len(block["context"].([]interface{})) > 0 && context != nil {
+				nicCtx = append(nicCtx, readNicContext(i, context.Attributes))
+			}
+		}
+		gateway, dns := "", ""
+		// without the groups of the vnet, only the configured ones can be told apart
+		var inherited map[int]bool
+		if vnet, err := client.vnetAddressRanges(nic.NetworkId); err == nil {
+			gateway, dns = vnet.Routing(nic.ArId)
+			inherited = map[int]bool{}
+			for _, id := range parseIdList(vnet.SecurityGroups) {
+				inherited[id] = true
+			}
+		} else {
+			log.Printf("[WARNING] Could not read the gateway and DNS of vnet %s: %s", nic.Network, err)
+		}
+		list = append(list, map[string]interface{}{
+			"network":            nic.Network,
+			"network_uname":      nic.NetworkUname,
+			"ip":                 nic.Ip,
+			"security_group_ids": nicOwnSecurityGroups(parseIdList(nic.SecurityGroups), configuredGroups, vmSecurityGroups, inherited),
+			"search_domain":      nic.NetworkSearchDomain,
+			"bandwidth":          readNicBandwidth(nic),
+			"raw":                nic.Raw,
+			"context":            nicCtx,
+			"nic_id":             nic.NicId,
+			"mac":                nic.Mac,
+			"gateway":            gateway,
+			"dns":                dns,
+		})
+	}
+
+	return list
+}
+
+// nicOwnSecurityGroups returns the configured security groups the NIC still has, followed by the
+// ones added to it that neither the VM nor the vnet account for. Without the groups of the vnet
+// (nil), only the configured ones are returned.
+func nicOwnSecurityGroups(groups []int, configured []interface{}, vm, vnet map[int]bool) []int {
+	present := map[int]bool{}
+	for _, id := range groups {
+		present[id] = true
+	}
+
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, id := range configured {
+		if present[id.(int)] && !seen[id.(int)] {
+			ids = append(ids, id.(int))
+			seen[id.(int)] = true
+		}
+	}
+	if vnet == nil {
+		return ids
+	}
+	for _, id := range groups {
+		if !seen[id] && !vm[id] && !vnet[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+
+	return ids
+}
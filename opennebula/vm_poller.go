@@ -0,0 +1,158 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// vmDonePoller terminates VMs and waits for them to be DONE. The terminate actions of all VMs
+// being deleted at the same time are sent first, then they share a single one.vmpool.info call
+// per poll interval, instead of polling one.vm.info each, so deleting a large fleet costs about
+// as much as deleting a single VM.
+type vmDonePoller struct {
+	client  *Client
+	mutex   sync.Mutex
+	waiters map[int]*vmDoneWaiter
+	running bool
+}
+
+// vmDoneWaiter is a VM to terminate, told through done once it's DONE or its action failed
+type vmDoneWaiter struct {
+	action string
+	sent   bool
+	done   chan error
+}
+
+// terminateVm terminates the VM with the delete action and waits for it to be DONE, sharing the
+// poller with all other deletions
+func (c *Client) terminateVm(id int, action string) error {
+	c.vmPollerOnce.Do(func() {
+		c.vmPoller = &vmDonePoller{
+			client:  c,
+			waiters: map[int]*vmDoneWaiter{},
+		}
+	})
+
+	return c.vmPoller.Wait(id, action, c.OperationTimeout)
+}
+
+// Wait queues the action of the VM and blocks until the VM is DONE, the action failed or the
+// timeout is over
+func (p *vmDonePoller) Wait(id int, action string, timeout time.Duration) error {
+	p.mutex.Lock()
+	waiter := &vmDoneWaiter{action: action, done: make(chan error, 1)}
+	p.waiters[id] = waiter
+	if !p.running {
+		p.running = true
+		go p.poll()
+	}
+	p.mutex.Unlock()
+
+	select {
+	case err := <-waiter.done:
+		return err
+	case <-time.After(timeout):
+		p.mutex.Lock()
+		if p.waiters[id] == waiter {
+			delete(p.waiters, id)
+		}
+		p.mutex.Unlock()
+		return fmt.Errorf("Error waiting for virtual machine (%d) to be in state DONE: timeout after %s", id, timeout)
+	}
+}
+
+func (p *vmDonePoller) poll() {
+	for {
+		// deletions starting meanwhile join the batch
+		time.Sleep(p.client.PollInterval)
+
+		p.mutex.Lock()
+		if len(p.waiters) == 0 {
+			p.running = false
+			p.mutex.Unlock()
+			return
+		}
+		unsent := map[int]*vmDoneWaiter{}
+		for id, waiter := range p.waiters {
+			if !waiter.sent {
+				unsent[id] = waiter
+			}
+		}
+		p.mutex.Unlock()
+
+		// all actions go out before the first poll of their VMs
+		for id, waiter := range unsent {
+			_, err := p.client.Call("one.vm.action", waiter.action, id)
+			p.mutex.Lock()
+			if err != nil {
+				waiter.done <- fmt.Errorf("Error sending %s to VM %d: %s", waiter.action, id, err)
+				delete(p.waiters, id)
+			} else {
+				waiter.sent = true
+			}
+			p.mutex.Unlock()
+		}
+
+		p.mutex.Lock()
+		first, last := -1, -1
+		for id, waiter := range p.waiters {
+			if !waiter.sent {
+				continue
+			}
+			if first == -1 || id < first {
+				first = id
+			}
+			if id > last {
+				last = id
+			}
+		}
+		p.mutex.Unlock()
+		if first == -1 {
+			continue
+		}
+
+		active, err := p.activeVms(first, last)
+		if err != nil {
+			log.Printf("[WARNING] Could not refresh the state of VMs %d to %d: %s", first, last, err)
+			continue
+		}
+
+		p.mutex.Lock()
+		for id, waiter := range p.waiters {
+			// VMs missing from the pool are DONE, or purged which only happens after DONE
+			if waiter.sent && !active[id] {
+				waiter.done <- nil
+				delete(p.waiters, id)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// activeVms returns the VMs of the user with an ID in the given range which aren't DONE
+func (p *vmDonePoller) activeVms(first, last int) (map[int]bool, error) {
+	var vms struct {
+		Vm []struct {
+			Id int `xml:"ID"`
+		} `xml:"VM"`
+	}
+
+	// all VMs visible to the user in any state but DONE, leaving out the ones deleted long ago
+	resp, err := p.client.Call("one.vmpool.info", -2, first, last, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vms); err != nil {
+		return nil, err
+	}
+
+	active := map[int]bool{}
+	for _, vm := range vms.Vm {
+		active[vm.Id] = true
+	}
+
+	return active, nil
+}
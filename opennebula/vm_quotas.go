@@ -0,0 +1,171 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Quotas are checked before instantiating a VM if the provider sets check_quotas, so an apply
+// doesn't fail halfway through on the VM exceeding them. They may still be exceeded by VMs
+// created by others in the meantime.
+
+// VmQuota is the VM quota of a user or group. Limits are -1 for the default quota and -2 for
+// unlimited, attributes missing in older OpenNebula versions are empty.
+type VmQuota struct {
+	Vms               string `xml:"VMS"`
+	VmsUsed           string `xml:"VMS_USED"`
+	Cpu               string `xml:"CPU"`
+	CpuUsed           string `xml:"CPU_USED"`
+	Memory            string `xml:"MEMORY"`
+	MemoryUsed        string `xml:"MEMORY_USED"`
+	RunningVms        string `xml:"RUNNING_VMS"`
+	RunningVmsUsed    string `xml:"RUNNING_VMS_USED"`
+	RunningCpu        string `xml:"RUNNING_CPU"`
+	RunningCpuUsed    string `xml:"RUNNING_CPU_USED"`
+	RunningMemory     string `xml:"RUNNING_MEMORY"`
+	RunningMemoryUsed string `xml:"RUNNING_MEMORY_USED"`
+}
+
+// exceeded returns the first quota the request would exceed, along with its usage and limit. Limits
+// of the default quota are taken from defaults. The RUNNING_* quotas only count a VM that runs.
+func (q *VmQuota) exceeded(defaults *VmQuota, vms, cpu, memory float64, running bool) (string, float64, float64) {
+	if defaults == nil {
+		defaults = &VmQuota{}
+	}
+	checks := []struct {
+		name             string
+		limit, def, used string
+		requested        float64
+		onlyRunning      bool
+	}{
+		{"VMS", q.Vms, defaults.Vms, q.VmsUsed, vms, false},
+		{"CPU", q.Cpu, defaults.Cpu, q.CpuUsed, cpu, false},
+		{"MEMORY", q.Memory, defaults.Memory, q.MemoryUsed, memory, false},
+		{"RUNNING_VMS", q.RunningVms, defaults.RunningVms, q.RunningVmsUsed, vms, true},
+		{"RUNNING_CPU", q.RunningCpu, defaults.RunningCpu, q.RunningCpuUsed, cpu, true},
+		{"RUNNING_MEMORY", q.RunningMemory, defaults.RunningMemory, q.RunningMemoryUsed, memory, true},
+	}
+
+	for _, check := range checks {
+		if check.onlyRunning && !running {
+			continue
+		}
+		limit, err := strconv.ParseFloat(check.limit, 64)
+		if err == nil && limit == -1 {
+			limit, err = strconv.ParseFloat(check.def, 64)
+		}
+		if err != nil || limit < 0 {
+			continue
+		}
+		used, _ := strconv.ParseFloat(check.used, 64)
+		if used+check.requested > limit {
+			return check.name, used, limit
+		}
+	}
+
+	return "", 0, 0
+}
+
+// validateVmQuotas fails if the VM doesn't fit into the VM quotas left to the user or its group.
+// CPU and memory not set on the VM are taken from its template.
+func validateVmQuotas(d *schema.ResourceDiff, meta interface{}) error {
+	var user struct {
+		Gid   int      `xml:"GID"`
+		Quota *VmQuota `xml:"VM_QUOTA>VM"`
+	}
+	var group struct {
+		Name  string   `xml:"NAME"`
+		Quota *VmQuota `xml:"VM_QUOTA>VM"`
+	}
+	var tmpl struct {
+		Cpu    float64 `xml:"TEMPLATE>CPU"`
+		Memory float64 `xml:"TEMPLATE>MEMORY"`
+	}
+
+	client := meta.(*Client)
+	if !client.CheckQuotas || !d.NewValueKnown("template_id") {
+		return nil
+	}
+
+	resp, err := client.Call("one.template.info", d.Get("template_id").(int), false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &tmpl); err != nil {
+		return err
+	}
+	cpu, memory := tmpl.Cpu, tmpl.Memory
+	if value, ok := d.GetOk("cpu"); ok {
+		cpu = float64(value.(int))
+	}
+	if value, ok := d.GetOk("memory"); ok {
+		memory = float64(value.(int))
+	}
+	// a VM held without a host to deploy it on, or stopped right away, doesn't run
+	_, pinned := d.GetOkExists("host_id")
+	state := d.Get("desired_state").(string)
+	running := (pinned || !d.Get("on_hold").(bool)) && (state == "" || state == "running")
+
+	resp, err = client.Call("one.user.info", -1, false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &user); err != nil {
+		return err
+	}
+	if user.Quota == nil {
+		user.Quota = unsetVmQuota()
+	}
+	defaults, err := defaultVmQuota(client, "one.userquota.info")
+	if err != nil {
+		return err
+	}
+	if name, used, limit := user.Quota.exceeded(defaults, 1, cpu, memory, running); name != "" {
+		return fmt.Errorf("Creating the VM would exceed the %s quota of user %s (%g/%g used)", name, client.Username, used, limit)
+	}
+
+	resp, err = client.Call("one.group.info", user.Gid, false)
+	if err != nil {
+		return err
+	}
+	if err = xml.Unmarshal([]byte(resp), &group); err != nil {
+		return err
+	}
+	if group.Quota == nil {
+		group.Quota = unsetVmQuota()
+	}
+	defaults, err = defaultVmQuota(client, "one.groupquota.info")
+	if err != nil {
+		return err
+	}
+	if name, used, limit := group.Quota.exceeded(defaults, 1, cpu, memory, running); name != "" {
+		return fmt.Errorf("Creating the VM would exceed the %s quota of group %s (%g/%g used)", name, group.Name, used, limit)
+	}
+
+	return nil
+}
+
+// unsetVmQuota is the VM quota of a user or group without one of its own, subject to the default one
+func unsetVmQuota() *VmQuota {
+	return &VmQuota{Vms: "-1", Cpu: "-1", Memory: "-1", RunningVms: "-1", RunningCpu: "-1", RunningMemory: "-1"}
+}
+
+// defaultVmQuota returns the default VM quota of users or groups, depending on the method
+func defaultVmQuota(client *Client, method string) (*VmQuota, error) {
+	var defaults struct {
+		Quota *VmQuota `xml:"VM_QUOTA>VM"`
+	}
+
+	resp, err := client.Call(method)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &defaults); err != nil {
+		return nil, err
+	}
+
+	return defaults.Quota, nil
+}
@@ -0,0 +1,196 @@
+package opennebula
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Scheduled actions other than the termination managed by ttl and terminate_at. Each block is
+// matched to its action by content rather than by its computed id, which shifts along with the
+// position of the block when another one is added or removed. A block changing anything but
+// its action and time is updated in place instead of rewriting all of them.
+
+// Values of REPEAT, by the name used in the sched_action block
+var schedActionRepeats = map[string]string{
+	"weekly":  "0",
+	"monthly": "1",
+	"yearly":  "2",
+	"hourly":  "3",
+}
+
+// schedActionTemplate renders a sched_action block as a SCHED_ACTION vector
+func schedActionTemplate(action map[string]interface{}) string {
+	at, _ := time.Parse(time.RFC3339, action["time"].(string))
+	attrs := map[string]string{
+		"ACTION": action["action"].(string),
+		"TIME":   strconv.FormatInt(at.Unix(), 10),
+	}
+
+	if repeat := action["repeat"].(string); repeat != "" {
+		attrs["REPEAT"] = schedActionRepeats[repeat]
+		attrs["DAYS"] = action["days"].(string)
+		// 0: repeat forever, 2: until END_VALUE
+		attrs["END_TYPE"] = "0"
+		if endTime, err := time.Parse(time.RFC3339, action["end_time"].(string)); err == nil {
+			attrs["END_TYPE"] = "2"
+			attrs["END_VALUE"] = strconv.FormatInt(endTime.Unix(), 10)
+		}
+	}
+
+	return vectorString("SCHED_ACTION", attrs)
+}
+
+// readSchedAction is the reverse of schedActionTemplate
+func readSchedAction(action *SchedAction) map[string]interface{} {
+	repeat := ""
+	for name, value := range schedActionRepeats {
+		if action.Repeat == value {
+			repeat = name
+		}
+	}
+
+	endTime := ""
+	if repeat != "" && action.EndType == "2" {
+		endTime = time.Unix(action.EndValue, 0).UTC().Format(time.RFC3339)
+	}
+
+	days := ""
+	if repeat != "" {
+		days = action.Days
+	}
+
+	return map[string]interface{}{
+		"id":       action.Id,
+		"action":   action.Action,
+		"time":     time.Unix(action.Time, 0).UTC().Format(time.RFC3339),
+		"repeat":   repeat,
+		"days":     days,
+		"end_time": endTime,
+	}
+}
+
+// vmManagedSchedActions returns the scheduled actions of the VM managed through sched_action,
+// by their ID
+func vmManagedSchedActions(vm *UserVm) map[int]*SchedAction {
+	actions := map[int]*SchedAction{}
+	for _, action := range vmSchedActions(vm) {
+		if action.Action != "terminate" && action.Action != "terminate-hard" {
+			actions[action.Id] = action
+		}
+	}
+
+	return actions
+}
+
+// matchSchedActions pairs each sched_action block with the scheduled action it stands for: the
+// one with the same content, or else the one with the same action and time. A block without
+// any is paired with nil.
+func matchSchedActions(blocks []interface{}, actions map[int]*SchedAction) []*SchedAction {
+	ids := []int{}
+	for id := range actions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	matched := make([]*SchedAction, len(blocks))
+	claimed := map[int]bool{}
+	sameAction := func(action *SchedAction, block map[string]interface{}) bool {
+		at, _ := time.Parse(time.RFC3339, block["time"].(string))
+		return action.Action == block["action"] && action.Time == at.Unix()
+	}
+	sameContent := func(action *SchedAction, block map[string]interface{}) bool {
+		return schedActionTemplate(readSchedAction(action)) == schedActionTemplate(block)
+	}
+	for _, same := range []func(*SchedAction, map[string]interface{}) bool{sameContent, sameAction} {
+		for i, v := range blocks {
+			for _, id := range ids {
+				if matched[i] == nil && !claimed[id] && same(actions[id], v.(map[string]interface{})) {
+					matched[i] = actions[id]
+					claimed[id] = true
+				}
+			}
+		}
+	}
+
+	return matched
+}
+
+// readSchedActions returns the scheduled actions of the VM in the order they're configured in,
+// followed by any others
+func readSchedActions(d *schema.ResourceData, vm *UserVm) []map[string]interface{} {
+	actions := vmManagedSchedActions(vm)
+
+	list := []map[string]interface{}{}
+	for _, action := range matchSchedActions(d.Get("sched_action").([]interface{}), actions) {
+		if action != nil {
+			list = append(list, readSchedAction(action))
+			delete(actions, action.Id)
+		}
+	}
+
+	ids := []int{}
+	for id := range actions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		list = append(list, readSchedAction(actions[id]))
+	}
+
+	return list
+}
+
+// resourceVmUpdateSchedActions adds, updates and deletes single scheduled actions of the VM
+func resourceVmUpdateSchedActions(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	vm, _, err := vmHotplugState(client, intId(d.Id()))
+	if err != nil {
+		return err
+	}
+	current := vmManagedSchedActions(vm)
+	blocks := d.Get("sched_action").([]interface{})
+	matched := matchSchedActions(blocks, current)
+
+	kept := map[int]bool{}
+	for i, v := range blocks {
+		action := v.(map[string]interface{})
+		template := schedActionTemplate(action)
+
+		existing := matched[i]
+		if existing == nil {
+			if _, err = client.Call("one.vm.schedadd", intId(d.Id()), template); err != nil {
+				return err
+			}
+			log.Printf("[INFO] Successfully scheduled %s for VM %s\n", action["action"], d.Id())
+			continue
+		}
+
+		id := existing.Id
+		kept[id] = true
+		if schedActionTemplate(readSchedAction(existing)) == template {
+			continue
+		}
+		if _, err = client.Call("one.vm.schedupdate", intId(d.Id()), id, template); err != nil {
+			return err
+		}
+		log.Printf("[INFO] Successfully updated scheduled action %d of VM %s\n", id, d.Id())
+	}
+
+	for id := range current {
+		if kept[id] {
+			continue
+		}
+		if _, err = client.Call("one.vm.scheddelete", intId(d.Id()), id); err != nil {
+			return fmt.Errorf("Error deleting scheduled action %d of VM %s: %s", id, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully deleted scheduled action %d of VM %s\n", id, d.Id())
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package opennebula
+
+import (
+	"encoding/xml"
+)
+
+// Sections of the VM template one.vm.updateconf replaces, all of them at once: a section left out
+// of its template is dropped from the VM, so the unchanged ones have to be sent along.
+var vmUpdateconfSections = []string{"OS", "FEATURES", "INPUT", "GRAPHICS", "RAW", "CONTEXT"}
+
+// vmUpdateconfTemplate renders all sections updateconf replaces, the changed ones as given and the
+// others as the VM has them. A section changed to "" is dropped.
+func vmUpdateconfTemplate(vm *UserVm, changed map[string]string) (string, error) {
+	current := &Vector{}
+	if err := xml.Unmarshal([]byte("<TEMPLATE>"+vm.VmTemplate.Raw+"</TEMPLATE>"), current); err != nil {
+		return "", err
+	}
+
+	template := ""
+	for _, name := range vmUpdateconfSections {
+		if section, ok := changed[name]; ok {
+			template += section
+			continue
+		}
+		for _, p := range current.Pairs {
+			if p.XMLName.Local == name {
+				template += (&Vector{Pairs: []*Pair{p}}).String()
+			}
+		}
+	}
+
+	return template, nil
+}
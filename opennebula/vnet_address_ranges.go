@@ -0,0 +1,275 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Address ranges of ar blocks, instead of the single range of ip_start and ip_size. Each block
+// is tied to its address range by the ID OpenNebula assigned it, found again by its type and
+// first address should the ID change.
+
+func addressRangeSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"type": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "IP4",
+			Description: "Type of the address range: IP4, IP6 or ETHER",
+			ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+				if value := v.(string); value != "IP4" && value != "IP6" && value != "ETHER" {
+					errors = append(errors, fmt.Errorf("%q must be IP4, IP6 or ETHER", k))
+				}
+
+				return
+			},
+		},
+		"ip": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			Description: "First IP of the address range, required for IP4",
+		},
+		"mac": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			Description: "First MAC of the address range, generated by OpenNebula otherwise",
+		},
+		"size": {
+			Type:        schema.TypeInt,
+			Required:    true,
+			Description: "Number of addresses in the address range",
+		},
+		"global_prefix": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Computed:    true,
+			Description: "Global prefix of the IPv6 addresses, for IP6",
+		},
+		"ar_id": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "ID of the address range in the vnet",
+		},
+	}
+}
+
+// addressRangeVector renders an ar block as an AR vector, with its ID to update an existing one
+func addressRangeVector(ar map[string]interface{}, id int) string {
+	attrs := map[string]string{
+		"TYPE": ar["type"].(string),
+		"SIZE": strconv.Itoa(ar["size"].(int)),
+	}
+	for arg, attr := range map[string]string{"ip": "IP", "mac": "MAC", "global_prefix": "GLOBAL_PREFIX"} {
+		if ar[arg].(string) != "" {
+			attrs[attr] = ar[arg].(string)
+		}
+	}
+	if id >= 0 {
+		attrs["AR_ID"] = strconv.Itoa(id)
+	}
+
+	return vectorString("AR", attrs)
+}
+
+// addAddressRange adds an ar block to the vnet and returns the ID OpenNebula assigned it, the one
+// which wasn't there before
+func addAddressRange(client *Client, vnetId int, ar map[string]interface{}) (int, error) {
+	before, err := vnetAddressRangeIds(client, vnetId)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = client.Call("one.vn.add_ar", vnetId, addressRangeVector(ar, -1)); err != nil {
+		return 0, fmt.Errorf("Error adding %s address range to Vnet %d: %s", ar["type"], vnetId, err)
+	}
+
+	after, err := vnetAddressRangeIds(client, vnetId)
+	if err != nil {
+		return 0, err
+	}
+	for id := range after {
+		if !before[id] {
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Could not find the address range added to Vnet %d", vnetId)
+}
+
+// vnetAddressRangeIds returns the IDs of the address ranges of the vnet, bypassing the cache
+func vnetAddressRangeIds(client *Client, vnetId int) (map[int]bool, error) {
+	var vn *UserVnet
+
+	resp, err := client.Call("one.vn.info", vnetId, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vn); err != nil {
+		return nil, err
+	}
+
+	ids := map[int]bool{}
+	for _, ar := range vn.Ars {
+		ids[ar.Id] = true
+	}
+
+	return ids, nil
+}
+
+// resourceVnetUpdateArs applies changed ar blocks: a changed size is updated in place, a changed
+// type or address replaces the address range, which fails while it has leases in use
+func resourceVnetUpdateArs(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+
+	o, n := d.GetChange("ar")
+	olds, news := o.([]interface{}), n.([]interface{})
+	matched := matchAddressRanges(olds, news)
+
+	kept := map[int]bool{}
+	for _, i := range matched {
+		kept[i] = true
+	}
+	for i, v := range olds {
+		if kept[i] {
+			continue
+		}
+		id := v.(map[string]interface{})["ar_id"].(int)
+		if _, err := client.Call("one.vn.rm_ar", intId(d.Id()), id); err != nil {
+			return fmt.Errorf("Error removing address range %d of Vnet %s: %s", id, d.Id(), err)
+		}
+		log.Printf("[INFO] Successfully removed address range %d of Vnet %s\n", id, d.Id())
+	}
+
+	ars := []interface{}{}
+	for i, v := range news {
+		ar := v.(map[string]interface{})
+		j, ok := matched[i]
+		if !ok {
+			id, err := addAddressRange(client, intId(d.Id()), ar)
+			if err != nil {
+				return err
+			}
+			log.Printf("[INFO] Successfully added address range %d to Vnet %s\n", id, d.Id())
+			ar["ar_id"] = id
+			ars = append(ars, ar)
+			continue
+		}
+
+		prev := olds[j].(map[string]interface{})
+		id := prev["ar_id"].(int)
+		if prev["size"] != ar["size"] {
+			if _, err := client.Call("one.vn.update_ar", intId(d.Id()), addressRangeVector(ar, id)); err != nil {
+				return fmt.Errorf("Error resizing address range %d of Vnet %s: %s", id, d.Id(), err)
+			}
+			log.Printf("[INFO] Successfully resized address range %d of Vnet %s\n", id, d.Id())
+		}
+		ar["ar_id"] = id
+		ars = append(ars, ar)
+	}
+
+	return d.Set("ar", ars)
+}
+
+// matchAddressRanges returns the index of the old ar block each new one updates, by its ar_id or
+// else, like readAddressRanges, by its type and first address. The list is diffed by position,
+// so a new block may carry the ar_id and computed MAC of another range; a block without a match
+// is added.
+func matchAddressRanges(olds, news []interface{}) map[int]int {
+	matches := func(prev, ar map[string]interface{}) bool {
+		// the first address is the IP, the MAC only for ETHER: a computed MAC may be another block's
+		first := "ip"
+		if ar["ip"] == "" {
+			first = "mac"
+		}
+
+		return prev["type"] == ar["type"] &&
+			(ar[first] == "" || ar[first] == prev[first]) &&
+			(ar["global_prefix"] == "" || ar["global_prefix"] == prev["global_prefix"])
+	}
+
+	claimed := map[int]bool{}
+	matched := map[int]int{}
+	for i, v := range news {
+		ar := v.(map[string]interface{})
+		for j, o := range olds {
+			prev := o.(map[string]interface{})
+			if !claimed[j] && prev["ar_id"] == ar["ar_id"] && matches(prev, ar) {
+				matched[i] = j
+				claimed[j] = true
+				break
+			}
+		}
+	}
+	for i, v := range news {
+		if _, ok := matched[i]; ok {
+			continue
+		}
+		ar := v.(map[string]interface{})
+		for j, o := range olds {
+			if !claimed[j] && matches(o.(map[string]interface{}), ar) {
+				matched[i] = j
+				claimed[j] = true
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// readAddressRanges returns the address ranges of the vnet in the order of the known ar blocks,
+// followed by the ones added outside of Terraform. A block whose ID is gone, e.g. as the range
+// was recreated, is matched by its type and first address instead.
+func readAddressRanges(known []interface{}, ars []*AddressRange) []map[string]interface{} {
+	matches := func(ar *AddressRange, block map[string]interface{}) bool {
+		return ar.Type == block["type"] &&
+			(block["ip"] == "" || ar.Ip == block["ip"]) &&
+			(block["mac"] == "" || ar.Mac == block["mac"])
+	}
+
+	claimed := map[int]bool{}
+	list := []map[string]interface{}{}
+	add := func(ar *AddressRange) {
+		claimed[ar.Id] = true
+		list = append(list, map[string]interface{}{
+			"type":          ar.Type,
+			"ip":            ar.Ip,
+			"mac":           ar.Mac,
+			"size":          ar.Size,
+			"global_prefix": ar.GlobalPrefix,
+			"ar_id":         ar.Id,
+		})
+	}
+
+	for _, v := range known {
+		block := v.(map[string]interface{})
+		var found *AddressRange
+		for _, ar := range ars {
+			if ar.Id == block["ar_id"] && !claimed[ar.Id] && matches(ar, block) {
+				found = ar
+			}
+		}
+		for _, ar := range ars {
+			if found == nil && !claimed[ar.Id] && matches(ar, block) {
+				found = ar
+			}
+		}
+		// a block without its range is dropped, so the next plan adds it again
+		if found != nil {
+			add(found)
+		}
+	}
+	for _, ar := range ars {
+		if !claimed[ar.Id] {
+			add(ar)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,98 @@
+package opennebula
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// How long the address ranges of a vnet are reused, so reading many VMs in the same vnet
+// doesn't call one.vn.info for each of them
+const vnetCacheLifetime = time.Minute
+
+type VnetAddressRanges struct {
+	Id  int             `xml:"ID"`
+	Ars []*AddressRange `xml:"AR_POOL>AR"`
+	// Set if the vnet is a reservation from another vnet
+	ParentNetworkId string `xml:"PARENT_NETWORK_ID"`
+	UsedLeases      int    `xml:"USED_LEASES"`
+	// Defaults for all address ranges
+	Gateway string `xml:"TEMPLATE>GATEWAY"`
+	Dns     string `xml:"TEMPLATE>DNS"`
+	// Added to every NIC leasing from the vnet
+	SecurityGroups string `xml:"TEMPLATE>SECURITY_GROUPS"`
+}
+
+type AddressRange struct {
+	Id           int    `xml:"AR_ID"`
+	Type         string `xml:"TYPE"`
+	Ip           string `xml:"IP"`
+	Mac          string `xml:"MAC"`
+	GlobalPrefix string `xml:"GLOBAL_PREFIX"`
+	Size         int    `xml:"SIZE"`
+	UsedLeases   int    `xml:"USED_LEASES"`
+	Gateway      string `xml:"GATEWAY"`
+	Dns          string `xml:"DNS"`
+}
+
+type cachedVnet struct {
+	vnet   *VnetAddressRanges
+	expiry time.Time
+}
+
+// Routing returns the gateway and DNS servers of a lease in the given address range. Attributes
+// the address range doesn't set are taken from the vnet.
+func (v *VnetAddressRanges) Routing(arId int) (string, string) {
+	gateway, dns := v.Gateway, v.Dns
+	for _, ar := range v.Ars {
+		if ar.Id != arId {
+			continue
+		}
+		if ar.Gateway != "" {
+			gateway = ar.Gateway
+		}
+		if ar.Dns != "" {
+			dns = ar.Dns
+		}
+	}
+
+	return gateway, dns
+}
+
+// FreeLeases returns the number of leases not used by any VM yet
+func (v *VnetAddressRanges) FreeLeases() int {
+	size := 0
+	for _, ar := range v.Ars {
+		size += ar.Size
+	}
+
+	return size - v.UsedLeases
+}
+
+// vnetAddressRanges returns the address ranges of a vnet, from the cache if they were fetched recently
+func (c *Client) vnetAddressRanges(id int) (*VnetAddressRanges, error) {
+	var vnet *VnetAddressRanges
+
+	c.vnetCacheMutex.Lock()
+	cached, ok := c.vnetCache[id]
+	c.vnetCacheMutex.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.vnet, nil
+	}
+
+	resp, err := c.Call("one.vn.info", id)
+	if err != nil {
+		return nil, err
+	}
+	if err = xml.Unmarshal([]byte(resp), &vnet); err != nil {
+		return nil, err
+	}
+
+	c.vnetCacheMutex.Lock()
+	if c.vnetCache == nil {
+		c.vnetCache = map[int]*cachedVnet{}
+	}
+	c.vnetCache[id] = &cachedVnet{vnet: vnet, expiry: time.Now().Add(vnetCacheLifetime)}
+	c.vnetCacheMutex.Unlock()
+
+	return vnet, nil
+}